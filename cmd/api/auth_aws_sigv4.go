@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// AWSSigV4Config configures AWS Signature Version 4 signing.
+// Blank values are taken from the standard AWS environment variables.
+type AWSSigV4Config struct {
+	Region          string // AWS_REGION or AWS_DEFAULT_REGION
+	Service         string // e.g. "execute-api"
+	AccessKeyID     string // AWS_ACCESS_KEY_ID
+	SecretAccessKey string // AWS_SECRET_ACCESS_KEY
+	SessionToken    string // AWS_SESSION_TOKEN
+	UnsignedPayload bool   // don't hash the body (S3 only)
+}
+
+func newAWSSigV4Client(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.AWSSigV4 == nil {
+		return nil, fmt.Errorf("aws-sigv4 auth not configured")
+	}
+	var deref apiconfig.Dereffer
+	client := &awsSigV4Client{
+		Client:          c.sendClient(),
+		Region:          deref.String(c.AWSSigV4.Region),
+		Service:         deref.String(c.AWSSigV4.Service),
+		AccessKeyID:     deref.String(c.AWSSigV4.AccessKeyID),
+		SecretAccessKey: deref.String(c.AWSSigV4.SecretAccessKey),
+		SessionToken:    deref.String(c.AWSSigV4.SessionToken),
+		UnsignedPayload: c.AWSSigV4.UnsignedPayload,
+	}
+	if deref.Error != nil {
+		return nil, deref.Error
+	}
+	if client.Region == "" {
+		client.Region = os.Getenv("AWS_REGION")
+	}
+	if client.Region == "" {
+		client.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if client.AccessKeyID == "" && client.SecretAccessKey == "" {
+		client.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if client.SessionToken == "" {
+			client.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+	switch {
+	case client.Region == "":
+		return nil, fmt.Errorf("aws-sigv4: no Region configured or in AWS_REGION")
+	case client.Service == "":
+		return nil, fmt.Errorf("aws-sigv4: no Service configured")
+	case client.AccessKeyID == "" || client.SecretAccessKey == "":
+		return nil, fmt.Errorf("aws-sigv4: no credentials configured or in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return client, nil
+}
+
+type awsSigV4Client struct {
+	Client          *http.Client
+	Region          string
+	Service         string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	UnsignedPayload bool
+}
+
+func (c *awsSigV4Client) Do(req *http.Request) (*http.Response, error) {
+	err := c.sign(req, time.Now())
+	if err != nil {
+		if req.Body != nil {
+			// http.Client.Do guarantees close, even on error.
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return c.Client.Do(req)
+}
+
+// These headers may be changed by proxies or the transport,
+// so they are never signed.
+var awsUnsignedHeaders = map[string]bool{
+	"authorization":     true,
+	"user-agent":        true,
+	"x-amzn-trace-id":   true,
+	"connection":        true,
+	"expect":            true,
+	"transfer-encoding": true,
+}
+
+// sign adds the SigV4 Authorization header and its companions to req,
+// as of time t.
+// A body that can't be replayed is read into memory to hash it.
+func (c *awsSigV4Client) sign(req *http.Request, t time.Time) error {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if !c.UnsignedPayload {
+		h := sha256.New()
+		if req.Body != nil {
+			err := bufferBody(req)
+			if err != nil {
+				return err
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	if c.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if awsUnsignedHeaders[k] {
+			continue
+		}
+		vals := make([]string, len(vs))
+		for i, v := range vs {
+			vals[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[k] = strings.Join(vals, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		c.canonicalURI(req.URL),
+		awsCanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/" + c.Service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, c.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+// canonicalURI returns the SigV4 canonical form of u's path.
+// S3 paths are used as they are, with each segment encoded once.
+// Other services normalize the path and encode the already-escaped segments again.
+func (c *awsSigV4Client) canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if c.Service == "s3" {
+		p = u.Path
+	} else if p != "" {
+		trailing := strings.HasSuffix(p, "/")
+		p = path.Clean("/" + p)
+		if trailing && p != "/" {
+			p += "/"
+		}
+	}
+	if p == "" {
+		return "/"
+	}
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = percentEncode(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func awsCanonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var pairs [][2]string
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		k, _ = url.QueryUnescape(k)
+		v, _ = url.QueryUnescape(v)
+		pairs = append(pairs, [2]string{percentEncode(k), percentEncode(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
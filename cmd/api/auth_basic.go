@@ -18,7 +18,7 @@ func newBasicAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
 	}
 	var deref apiconfig.Dereffer
 	return basicAuthClient{
-		Client:   http.DefaultClient,
+		Client:   c.sendClient(),
 		Username: deref.String(c.BasicAuth.Username),
 		Password: deref.String(c.BasicAuth.Password),
 	}, deref.Error
@@ -20,7 +20,7 @@ func newBearerAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
 	if c.BearerAuth.Prefix == "" {
 		c.BearerAuth.Prefix = "Bearer"
 	}
-	client := bearerAuthClient{Client: http.DefaultClient}
+	client := bearerAuthClient{Client: c.sendClient()}
 	var deref apiconfig.Dereffer
 	if c.BearerAuth.NoPrefix {
 		client.Authorization = deref.String(c.BearerAuth.Token)
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+func newDigestAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.DigestAuth == nil {
+		return nil, fmt.Errorf("digest auth not configured")
+	}
+	var deref apiconfig.Dereffer
+	return &digestAuthClient{
+		Client:   c.sendClient(),
+		Username: deref.String(c.DigestAuth.Username),
+		Password: deref.String(c.DigestAuth.Password),
+	}, deref.Error
+}
+
+// digestAuthClient does RFC 7616 HTTP Digest authentication.
+// After the first challenge, later requests answer it preemptively,
+// counting nonce uses, until the server sends a new challenge.
+type digestAuthClient struct {
+	Client   *http.Client
+	Username string
+	Password string
+
+	mu        sync.Mutex // guards challenge and nc
+	challenge *digestChallenge
+	nc        int
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string // the qop we chose: "auth", "auth-int", or blank
+}
+
+func (c *digestAuthClient) Do(req *http.Request) (*http.Response, error) {
+	err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if ch := c.currentChallenge(); ch != nil {
+		err = c.authorize(req, ch)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	ch := parseDigestChallenges(resp.Header.Values("WWW-Authenticate"))
+	if ch == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	c.mu.Lock()
+	c.challenge = ch
+	c.nc = 0
+	c.mu.Unlock()
+
+	req = req.Clone(req.Context())
+	if req.GetBody != nil {
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = c.authorize(req, ch)
+	if err != nil {
+		if req.Body != nil {
+			// http.Client.Do guarantees close, even on error.
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return c.Client.Do(req)
+}
+
+func (c *digestAuthClient) currentChallenge() *digestChallenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.challenge
+}
+
+func (c *digestAuthClient) nextNonceCount() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc++
+	return fmt.Sprintf("%08x", c.nc)
+}
+
+func (c *digestAuthClient) authorize(req *http.Request, ch *digestChallenge) error {
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(ch.algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return fmt.Errorf("digest auth: unsupported algorithm %s", ch.algorithm)
+	}
+	h := func(s string) string {
+		x := newHash()
+		io.WriteString(x, s)
+		return hex.EncodeToString(x.Sum(nil))
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	cnonce := hex.EncodeToString(b)
+	uri := req.URL.RequestURI()
+
+	ha1 := h(c.Username + ":" + ch.realm + ":" + c.Password)
+	if strings.HasSuffix(strings.ToUpper(ch.algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	if ch.qop == "auth-int" {
+		bodyHash := newHash()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(bodyHash, body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		ha2 = h(req.Method + ":" + uri + ":" + hex.EncodeToString(bodyHash.Sum(nil)))
+	}
+
+	var auth strings.Builder
+	fmt.Fprintf(&auth, `Digest username=%q, realm=%q, nonce=%q, uri=%q`, c.Username, ch.realm, ch.nonce, uri)
+	if ch.algorithm != "" {
+		fmt.Fprintf(&auth, ", algorithm=%s", ch.algorithm)
+	}
+	if ch.qop != "" {
+		nc := c.nextNonceCount()
+		response := h(ha1 + ":" + ch.nonce + ":" + nc + ":" + cnonce + ":" + ch.qop + ":" + ha2)
+		fmt.Fprintf(&auth, `, response=%q, qop=%s, nc=%s, cnonce=%q`, response, ch.qop, nc, cnonce)
+	} else {
+		// RFC 2069 compatibility
+		fmt.Fprintf(&auth, `, response=%q`, h(ha1+":"+ch.nonce+":"+ha2))
+	}
+	if ch.opaque != "" {
+		fmt.Fprintf(&auth, ", opaque=%q", ch.opaque)
+	}
+	req.Header.Set("Authorization", auth.String())
+	return nil
+}
+
+// parseDigestChallenges picks the strongest Digest challenge
+// from WWW-Authenticate header values.
+func parseDigestChallenges(headers []string) *digestChallenge {
+	var best *digestChallenge
+	for _, h := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		params := parseAuthParams(rest)
+		ch := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		switch alg := strings.TrimSuffix(strings.ToUpper(ch.algorithm), "-SESS"); alg {
+		case "", "MD5", "SHA-256":
+		default:
+			continue
+		}
+		if qop, ok := params["qop"]; ok {
+			for _, q := range strings.Split(qop, ",") {
+				q = strings.TrimSpace(q)
+				if q == "auth" || (q == "auth-int" && ch.qop == "") {
+					ch.qop = q
+				}
+			}
+			if ch.qop == "" {
+				continue
+			}
+		}
+		if best == nil || strings.HasPrefix(strings.ToUpper(ch.algorithm), "SHA-256") {
+			best = ch
+		}
+	}
+	return best
+}
+
+// parseAuthParams parses comma-separated key=value auth parameters,
+// where values may be quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		rest = strings.TrimLeft(rest, " \t")
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			v = b.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			v, s, _ = strings.Cut(rest, ",")
+			v = strings.TrimSpace(v)
+		}
+		params[k] = v
+	}
+	return params
+}
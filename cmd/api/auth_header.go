@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// HeaderAuthConfig maps header names to values, such as X-API-Key.
+// Besides being its own auth type, it is added to requests
+// made with any other auth type when configured.
+type HeaderAuthConfig map[string]string
+
+func newHeaderAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.HeaderAuth == nil {
+		return nil, fmt.Errorf("header auth not configured")
+	}
+	return wrapHeaderAuth(c, c.sendClient())
+}
+
+// wrapHeaderAuth returns a Client that sets the HeaderAuth headers
+// before passing requests to next.
+func wrapHeaderAuth(c *Config, next Client) (Client, error) {
+	var deref apiconfig.Dereffer
+	return headerAuthClient{
+		Client: next,
+		Header: deref.StringMap(c.HeaderAuth),
+	}, deref.Error
+}
+
+type headerAuthClient struct {
+	Client Client
+	Header HeaderAuthConfig
+}
+
+func (c headerAuthClient) Do(req *http.Request) (*http.Response, error) {
+	for k, v := range c.Header {
+		req.Header.Set(k, v)
+	}
+	return c.Client.Do(req)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// HMACAuthConfig describes a vendor-specific HMAC request signing scheme.
+// Canonical, Nonce and the Header values are templates
+// executed with hmacTemplateData.
+type HMACAuthConfig struct {
+	Key             string            // the secret, usually a reference
+	KeyEncoding     string            // how Key is written: raw (default), base64, hex
+	Algorithm       string            // digest for the HMAC and BodyHash: sha256 (default), sha1, sha512, md5
+	Encoding        string            // signature and BodyHash encoding: base64 (default), base64url, hex
+	TimestampFormat string            // unix (default), unixms, or a Go time layout; always UTC
+	Nonce           string            // defaults to random hex
+	Canonical       string            // the string to sign
+	Header          map[string]string // headers to set, usually including {{.Signature}}
+}
+
+type hmacTemplateData struct {
+	Method    string
+	URL       string // the full request URL
+	Host      string
+	Path      string // escaped
+	Query     string // raw query, without "?"
+	Header    http.Header
+	Body      string
+	BodyHash  string // digest of Body, encoded like the signature
+	Timestamp string
+	Nonce     string
+	Signature string // only set for Header templates
+	Data      map[string]any
+}
+
+func newHMACAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.HMACAuth == nil {
+		return nil, fmt.Errorf("hmac auth not configured")
+	}
+	if c.HMACAuth.Canonical == "" || len(c.HMACAuth.Header) == 0 {
+		return nil, fmt.Errorf("hmac auth needs Canonical and Header")
+	}
+	var deref apiconfig.Dereffer
+	key := deref.String(c.HMACAuth.Key)
+	if deref.Error != nil {
+		return nil, deref.Error
+	}
+	client := &hmacAuthClient{
+		Client: c.sendClient(),
+		Config: c.HMACAuth,
+		Data:   c.Data,
+	}
+	var err error
+	switch c.HMACAuth.KeyEncoding {
+	case "", "raw":
+		client.Key = []byte(key)
+	case "base64":
+		client.Key, err = base64.StdEncoding.DecodeString(key)
+	case "hex":
+		client.Key, err = hex.DecodeString(key)
+	default:
+		err = fmt.Errorf("unknown KeyEncoding %s", c.HMACAuth.KeyEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hmac auth Key: %w", err)
+	}
+	switch c.HMACAuth.Algorithm {
+	case "", "sha256":
+		client.hash = sha256.New
+	case "sha1":
+		client.hash = sha1.New
+	case "sha512":
+		client.hash = sha512.New
+	case "md5":
+		client.hash = md5.New
+	default:
+		return nil, fmt.Errorf("hmac auth: unknown Algorithm %s", c.HMACAuth.Algorithm)
+	}
+	switch c.HMACAuth.Encoding {
+	case "", "base64":
+		client.encode = base64.StdEncoding.EncodeToString
+	case "base64url":
+		client.encode = base64.RawURLEncoding.EncodeToString
+	case "hex":
+		client.encode = hex.EncodeToString
+	default:
+		return nil, fmt.Errorf("hmac auth: unknown Encoding %s", c.HMACAuth.Encoding)
+	}
+	return client, nil
+}
+
+type hmacAuthClient struct {
+	Client *http.Client
+	Config *HMACAuthConfig
+	Key    []byte
+	Data   map[string]any
+	hash   func() hash.Hash
+	encode func([]byte) string
+}
+
+func (c *hmacAuthClient) Do(req *http.Request) (*http.Response, error) {
+	err := c.sign(req, time.Now())
+	if err != nil {
+		if req.Body != nil {
+			// http.Client.Do guarantees close, even on error.
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return c.Client.Do(req)
+}
+
+func (c *hmacAuthClient) sign(req *http.Request, t time.Time) error {
+	var body []byte
+	if req.Body != nil {
+		err := bufferBody(req)
+		if err != nil {
+			return err
+		}
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	bodyHash := c.hash()
+	bodyHash.Write(body)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	data := hmacTemplateData{
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Host:      host,
+		Path:      req.URL.EscapedPath(),
+		Query:     req.URL.RawQuery,
+		Header:    req.Header,
+		Body:      string(body),
+		BodyHash:  c.encode(bodyHash.Sum(nil)),
+		Timestamp: hmacTimestamp(c.Config.TimestampFormat, t),
+		Data:      c.Data,
+	}
+	var err error
+	if c.Config.Nonce != "" {
+		data.Nonce, err = templateString(c.Config.Nonce, data)
+		if err != nil {
+			return fmt.Errorf("hmac auth Nonce: %w", err)
+		}
+	} else {
+		b := make([]byte, 16)
+		_, err = rand.Read(b)
+		if err != nil {
+			return err
+		}
+		data.Nonce = hex.EncodeToString(b)
+	}
+	canonical, err := templateString(c.Config.Canonical, data)
+	if err != nil {
+		return fmt.Errorf("hmac auth Canonical: %w", err)
+	}
+	mac := hmac.New(c.hash, c.Key)
+	mac.Write([]byte(canonical))
+	data.Signature = c.encode(mac.Sum(nil))
+	for k, v := range c.Config.Header {
+		v, err = templateString(v, data)
+		if err != nil {
+			return fmt.Errorf("hmac auth Header %s: %w", k, err)
+		}
+		req.Header.Set(k, v)
+	}
+	return nil
+}
+
+func hmacTimestamp(format string, t time.Time) string {
+	t = t.UTC()
+	switch strings.ToLower(format) {
+	case "", "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.Format(format)
+	}
+}
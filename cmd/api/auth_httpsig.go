@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gonuts/commander"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// HTTPSigConfig configures RFC 9421 HTTP Message Signatures.
+type HTTPSigConfig struct {
+	KeyID      string
+	Algorithm  string   // ed25519 (default), rsa-pss-sha512, ecdsa-p256-sha256, hmac-sha256
+	Key        string   // PEM private key, or the secret for hmac-sha256; usually a reference
+	VerifyKey  string   // PEM public key for verify-signature; defaults to the public half of Key
+	Components []string // defaults to "@method", "@target-uri", and "content-digest" when there is a body
+	Label      string   // defaults to "sig1"
+	Tag        string
+	Nonce      bool     // add a random nonce parameter
+	Expires    duration // add an expires parameter this far after created
+	Digest     string   // Content-Digest algorithm: sha-256 (default) or sha-512
+}
+
+func newHTTPSigCommands() []*commander.Command {
+	cmds := []*commander.Command{
+		{
+			UsageLine: "verify-signature [-key key] [-scheme https] [file]",
+			Short:     "check the HTTP message signatures of a captured request or response",
+			Long: `
+verify-signature reads an HTTP/1.1 request or response, as sent on the wire,
+from the named file or standard input.
+It checks Content-Digest and every signature in the message,
+printing the signature base for each, so mismatches can be debugged.
+`,
+			Flag: *flag.NewFlagSet("verify-signature", flag.ExitOnError),
+			Run:  runVerifySignature,
+		},
+	}
+	cmds[0].Flag.String("key", "", "verification key or reference (default from config)")
+	cmds[0].Flag.String("scheme", "https", "URL scheme of a captured request")
+	return cmds
+}
+
+func newHTTPSigClient(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.HTTPSig == nil {
+		return nil, fmt.Errorf("httpsig auth not configured")
+	}
+	var deref apiconfig.Dereffer
+	key := deref.String(c.HTTPSig.Key)
+	if deref.Error != nil {
+		return nil, deref.Error
+	}
+	alg := c.HTTPSig.algorithm()
+	client := &httpsigClient{
+		Client: c.sendClient(),
+		Config: c.HTTPSig,
+		alg:    alg,
+	}
+	if alg == "hmac-sha256" {
+		client.secret = []byte(key)
+		return client, nil
+	}
+	var err error
+	client.key, err = parsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("httpsig Key: %w", err)
+	}
+	err = checkHTTPSigKey(alg, client.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *HTTPSigConfig) algorithm() string {
+	if c.Algorithm == "" {
+		return "ed25519"
+	}
+	return c.Algorithm
+}
+
+type httpsigClient struct {
+	Client *http.Client
+	Config *HTTPSigConfig
+	alg    string
+	key    crypto.Signer
+	secret []byte
+}
+
+func (c *httpsigClient) Do(req *http.Request) (*http.Response, error) {
+	err := c.sign(req, time.Now())
+	if err != nil {
+		if req.Body != nil {
+			// http.Client.Do guarantees close, even on error.
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return c.Client.Do(req)
+}
+
+func (c *httpsigClient) sign(req *http.Request, t time.Time) error {
+	components := c.Config.Components
+	if req.Body != nil {
+		err := bufferBody(req)
+		if err != nil {
+			return err
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		digest, err := contentDigest(c.Config.Digest, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Digest", digest)
+		if components == nil {
+			components = []string{"@method", "@target-uri", "content-digest"}
+		}
+	} else if components == nil {
+		components = []string{"@method", "@target-uri"}
+	}
+
+	var params strings.Builder
+	params.WriteString("(")
+	for i, name := range components {
+		if i > 0 {
+			params.WriteString(" ")
+		}
+		params.WriteString(strconv.Quote(strings.ToLower(name)))
+	}
+	params.WriteString(")")
+	fmt.Fprintf(&params, ";created=%d", t.Unix())
+	if c.Config.Expires > 0 {
+		fmt.Fprintf(&params, ";expires=%d", t.Add(time.Duration(c.Config.Expires)).Unix())
+	}
+	if c.Config.Nonce {
+		fmt.Fprintf(&params, ";nonce=%q", randomString())
+	}
+	if c.Config.KeyID != "" {
+		fmt.Fprintf(&params, ";keyid=%q", c.Config.KeyID)
+	}
+	fmt.Fprintf(&params, ";alg=%q", c.alg)
+	if c.Config.Tag != "" {
+		fmt.Fprintf(&params, ";tag=%q", c.Config.Tag)
+	}
+
+	m := &httpsigMessage{Method: req.Method, URL: req.URL, Header: req.Header}
+	if req.Host != "" {
+		u := *req.URL
+		u.Host = req.Host
+		m.URL = &u
+	}
+	base, err := m.signatureBase(components, params.String())
+	if err != nil {
+		return err
+	}
+	sig, err := c.signBase([]byte(base))
+	if err != nil {
+		return err
+	}
+	label := c.Config.Label
+	if label == "" {
+		label = "sig1"
+	}
+	req.Header.Set("Signature-Input", label+"="+params.String())
+	req.Header.Set("Signature", label+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+func (c *httpsigClient) signBase(base []byte) ([]byte, error) {
+	switch c.alg {
+	case "ed25519":
+		return c.key.Sign(rand.Reader, base, crypto.Hash(0))
+	case "rsa-pss-sha512":
+		h := sha512.Sum512(base)
+		return c.key.Sign(rand.Reader, h[:], &rsa.PSSOptions{SaltLength: 64, Hash: crypto.SHA512})
+	case "ecdsa-p256-sha256":
+		return signSHA256(c.key, base)
+	case "hmac-sha256":
+		mac := hmac.New(sha256.New, c.secret)
+		mac.Write(base)
+		return mac.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("httpsig: unknown Algorithm %s", c.alg)
+	}
+}
+
+// checkHTTPSigKey reports whether pub is the right kind of key for alg.
+func checkHTTPSigKey(alg string, pub crypto.PublicKey) error {
+	ok := false
+	switch alg {
+	case "ed25519":
+		_, ok = pub.(ed25519.PublicKey)
+	case "rsa-pss-sha512":
+		_, ok = pub.(*rsa.PublicKey)
+	case "ecdsa-p256-sha256":
+		k, isEC := pub.(*ecdsa.PublicKey)
+		ok = isEC && k.Curve.Params().Name == "P-256"
+	default:
+		return fmt.Errorf("httpsig: unknown Algorithm %s", alg)
+	}
+	if !ok {
+		return fmt.Errorf("httpsig: %T key can't be used with %s", pub, alg)
+	}
+	return nil
+}
+
+func verifyHTTPSig(alg string, key any, base, sig []byte) error {
+	ok := false
+	switch alg {
+	case "ed25519":
+		pub, _ := key.(ed25519.PublicKey)
+		ok = pub != nil && ed25519.Verify(pub, base, sig)
+	case "rsa-pss-sha512":
+		pub, _ := key.(*rsa.PublicKey)
+		h := sha512.Sum512(base)
+		ok = pub != nil && rsa.VerifyPSS(pub, crypto.SHA512, h[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil
+	case "ecdsa-p256-sha256":
+		pub, _ := key.(*ecdsa.PublicKey)
+		h := sha256.Sum256(base)
+		if pub != nil && len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			ok = ecdsa.Verify(pub, h[:], r, s)
+		}
+	case "hmac-sha256":
+		secret, _ := key.([]byte)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(base)
+		ok = hmac.Equal(mac.Sum(nil), sig)
+	default:
+		return fmt.Errorf("unknown algorithm %s", alg)
+	}
+	if !ok {
+		return fmt.Errorf("signature does not verify")
+	}
+	return nil
+}
+
+// contentDigest returns an RFC 9530 Content-Digest header value for body.
+func contentDigest(alg string, body io.Reader) (string, error) {
+	var h hash.Hash
+	switch alg {
+	case "", "sha-256":
+		alg, h = "sha-256", sha256.New()
+	case "sha-512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unknown Content-Digest algorithm %s", alg)
+	}
+	_, err := io.Copy(h, body)
+	if err != nil {
+		return "", err
+	}
+	return alg + "=:" + base64.StdEncoding.EncodeToString(h.Sum(nil)) + ":", nil
+}
+
+// httpsigMessage is the part of a request or response
+// that signature components are drawn from.
+type httpsigMessage struct {
+	Method string   // requests only
+	URL    *url.URL // requests only, with Host set
+	Status int      // responses only
+	Header http.Header
+}
+
+func (m *httpsigMessage) component(name string) (string, error) {
+	if m.URL == nil && name != "@status" && strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("component %s is not available in a response", name)
+	}
+	switch name {
+	case "@method":
+		return m.Method, nil
+	case "@target-uri":
+		return m.URL.String(), nil
+	case "@authority":
+		return strings.ToLower(m.URL.Host), nil
+	case "@scheme":
+		return strings.ToLower(m.URL.Scheme), nil
+	case "@request-target":
+		return m.URL.RequestURI(), nil
+	case "@path":
+		if p := m.URL.EscapedPath(); p != "" {
+			return p, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + m.URL.RawQuery, nil
+	case "@status":
+		if m.Status == 0 {
+			return "", fmt.Errorf("component @status is only available in a response")
+		}
+		return strconv.Itoa(m.Status), nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("unsupported component %s", name)
+	}
+	vals, ok := m.Header[http.CanonicalHeaderKey(name)]
+	if !ok {
+		return "", fmt.Errorf("component %s: header not present", name)
+	}
+	trimmed := make([]string, len(vals))
+	for i, v := range vals {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// signatureBase builds the RFC 9421 signature base.
+// params is the serialized inner list and parameters from Signature-Input.
+func (m *httpsigMessage) signatureBase(components []string, params string) (string, error) {
+	var b strings.Builder
+	for _, name := range components {
+		name = strings.ToLower(name)
+		v, err := m.component(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%q: %s\n", name, v)
+	}
+	fmt.Fprintf(&b, "\"@signature-params\": %s", params)
+	return b.String(), nil
+}
+
+func runVerifySignature(cmd *commander.Command, args []string) error {
+	if len(args) > 1 {
+		cmd.Usage()
+		return fmt.Errorf("wrong number of arguments, got %d want 0 or 1", len(args))
+	}
+	var in io.Reader = os.Stdin
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	m, body, err := readHTTPSigMessage(bufio.NewReader(in), cmd.Lookup("scheme").(string))
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	if cd := m.Header.Get("Content-Digest"); cd != "" {
+		alg, _, _ := strings.Cut(cd, "=")
+		want, err := contentDigest(alg, bytes.NewReader(body))
+		switch {
+		case err != nil:
+			fmt.Println("Content-Digest:", err)
+		case want != cd:
+			fmt.Println("Content-Digest: MISMATCH, body digest is", want)
+			failed = true
+		default:
+			fmt.Println("Content-Digest: ok")
+		}
+	}
+
+	inputs, err := parseSignatureInput(m.Header.Get("Signature-Input"))
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("no Signature-Input header")
+	}
+	sigs, err := parseSignatureHeader(m.Header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+	keyRef := cmd.Lookup("key").(string)
+	sigConfig := commandConfig(cmd).HTTPSig
+	for _, in := range inputs {
+		fmt.Printf("\n%s:\n", in.label)
+		base, err := m.signatureBase(in.components, in.params)
+		if err != nil {
+			fmt.Println("  error:", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  signature base:\n%s\n", indent(base, "    "))
+		alg := in.alg
+		if alg == "" && sigConfig != nil {
+			alg = sigConfig.algorithm()
+		}
+		key, err := httpsigVerifyKey(sigConfig, keyRef, alg)
+		if err == nil {
+			sig, ok := sigs[in.label]
+			if !ok {
+				err = fmt.Errorf("no matching Signature value")
+			} else {
+				err = verifyHTTPSig(alg, key, []byte(base), sig)
+			}
+		}
+		if err != nil {
+			fmt.Println("  FAILED:", err)
+			failed = true
+			continue
+		}
+		fmt.Println("  ok")
+	}
+	if failed {
+		return fmt.Errorf("verification failed")
+	}
+	return nil
+}
+
+func indent(s, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
+
+// readHTTPSigMessage reads a request or response in HTTP/1.1 wire format.
+func readHTTPSigMessage(r *bufio.Reader, scheme string) (*httpsigMessage, []byte, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(start) == "HTTP/" {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return &httpsigMessage{Status: resp.StatusCode, Header: resp.Header}, body, err
+	}
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	u := *req.URL
+	if u.Scheme == "" {
+		u.Scheme = scheme
+	}
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	return &httpsigMessage{Method: req.Method, URL: &u, Header: req.Header}, body, err
+}
+
+type signatureInput struct {
+	label      string
+	components []string
+	params     string // serialized value, for @signature-params
+	alg        string
+}
+
+// parseSignatureInput parses the Signature-Input dictionary.
+// It handles the plain component identifiers we produce,
+// not the full structured field syntax.
+func parseSignatureInput(h string) ([]signatureInput, error) {
+	var inputs []signatureInput
+	for _, member := range splitSFList(h) {
+		label, value, ok := strings.Cut(member, "=")
+		if !ok || !strings.HasPrefix(value, "(") {
+			return nil, fmt.Errorf("malformed Signature-Input: %s", member)
+		}
+		end := strings.Index(value, ")")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed Signature-Input: %s", member)
+		}
+		in := signatureInput{label: strings.TrimSpace(label), params: value}
+		for _, item := range strings.Fields(value[1:end]) {
+			name, err := strconv.Unquote(item)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported component identifier %s in Signature-Input", item)
+			}
+			in.components = append(in.components, name)
+		}
+		for _, p := range strings.Split(value[end+1:], ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k == "alg" {
+				in.alg, _ = strconv.Unquote(v)
+			}
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+func parseSignatureHeader(h string) (map[string][]byte, error) {
+	sigs := make(map[string][]byte)
+	for _, member := range splitSFList(h) {
+		label, value, _ := strings.Cut(member, "=")
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("malformed Signature: %s", member)
+		}
+		b, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed Signature: %w", err)
+		}
+		sigs[strings.TrimSpace(label)] = b
+	}
+	return sigs, nil
+}
+
+// splitSFList splits a structured field list or dictionary at top-level commas.
+func splitSFList(h string) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(h); i++ {
+		switch c := h[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(h[start:i]))
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(h[start:]); s != "" {
+		parts = append(parts, s)
+	}
+	return parts
+}
+
+// httpsigVerifyKey loads the key for verify-signature:
+// the -key flag, else VerifyKey, else the public half of Key.
+func httpsigVerifyKey(c *HTTPSigConfig, ref, alg string) (any, error) {
+	if ref == "" && c != nil {
+		ref = c.VerifyKey
+		if ref == "" {
+			ref = c.Key
+		}
+	}
+	if ref == "" {
+		return nil, fmt.Errorf("no verification key: use -key")
+	}
+	s, err := apiconfig.Deref(ref)
+	if err != nil {
+		return nil, err
+	}
+	if alg == "hmac-sha256" {
+		return []byte(s), nil
+	}
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in verification key")
+	}
+	var pub crypto.PublicKey
+	if strings.Contains(block.Type, "PRIVATE") {
+		k, err := parsePrivateKey(s)
+		if err != nil {
+			return nil, err
+		}
+		pub = k.Public()
+	} else {
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pub, checkHTTPSigKey(alg, pub)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto"
+	"crypto/rsa"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gonuts/commander"
@@ -17,7 +22,19 @@ type OAuth1Config struct {
 	ConsumerKey    string
 	ConsumerSecret string
 
-	//CallbackURL string // Do service providers allow localhost callback URLs?
+	// HMAC-SHA1 (default), HMAC-SHA256, RSA-SHA1, RSA-SHA256, or PLAINTEXT.
+	// The RSA methods sign with PrivateKey, a PEM key, instead of ConsumerSecret.
+	SignatureMethod string
+	PrivateKey      string
+
+	// TwoLegged signs requests with only the consumer credentials,
+	// with no access token and no auth step.
+	TwoLegged bool
+
+	// CallbackURL, if set, is a local URL such as http://127.0.0.1:8765/callback.
+	// The auth command listens there for the verifier instead of
+	// asking for it to be pasted.
+	CallbackURL string
 
 	// Service Provider Info
 	RequestTokenURL   string
@@ -40,6 +57,11 @@ func (c *OAuth1Config) deref() (*OAuth1Config, error) {
 	return &OAuth1Config{
 		ConsumerKey:    deref.String(c.ConsumerKey),
 		ConsumerSecret: deref.String(c.ConsumerSecret),
+		CallbackURL:    deref.String(c.CallbackURL),
+
+		SignatureMethod: c.SignatureMethod,
+		PrivateKey:      deref.String(c.PrivateKey),
+		TwoLegged:       c.TwoLegged,
 
 		RequestTokenURL:   deref.String(c.RequestTokenURL),
 		AuthorizeTokenURL: deref.String(c.AuthorizeTokenURL),
@@ -56,27 +78,36 @@ func (c *OAuth1Config) deref() (*OAuth1Config, error) {
 	}, deref.Error
 }
 
-var oauth1Commands = []*commander.Command{
-	{
-		UsageLine: "auth [-reset] [verification-code]",
-		Short:     "do OAuth 1.0 authorization",
-		Flag:      *flag.NewFlagSet("auth", flag.ExitOnError),
-		Run:       runOAuth1,
-	},
-}
-
-func init() {
-	oauth1Commands[0].Flag.Bool("reset", false, "ignore existing credentials and start over")
+func newOAuth1Commands() []*commander.Command {
+	cmds := []*commander.Command{
+		{
+			UsageLine: "auth [-reset] [verification-code or callback url]",
+			Short:     "do OAuth 1.0 authorization",
+			Flag:      *flag.NewFlagSet("auth", flag.ExitOnError),
+			Run:       runOAuth1,
+		},
+	}
+	cmds[0].Flag.Bool("reset", false, "ignore existing credentials and start over")
+	return cmds
 }
 
 func runOAuth1(cmd *commander.Command, args []string) error {
-	if config.OAuth1 == nil {
+	cfg := commandConfig(cmd)
+	if cfg.OAuth1 == nil {
 		return fmt.Errorf("oauth1 not configured")
 	}
-	c, err := newOAuth1ClientConcrete(config.OAuth1, authState)
+	state, err := cfg.typeState("oauth1")
 	if err != nil {
 		return err
 	}
+	c, err := newOAuth1ClientConcrete(cfg.OAuth1, state)
+	if err != nil {
+		return err
+	}
+	if c.config.TwoLegged {
+		fmt.Println("two-legged OAuth needs no authorization")
+		return nil
+	}
 	if cmd.Lookup("reset").(bool) {
 		err := c.resetAuth()
 		if err != nil {
@@ -89,7 +120,10 @@ func runOAuth1(cmd *commander.Command, args []string) error {
 	}
 	switch len(args) {
 	case 0:
-		accessURL, err := c.requestAccess()
+		if c.config.CallbackURL != "" {
+			return c.authWithCallback(cmd.Context())
+		}
+		accessURL, err := c.requestAccess("oob")
 		if err != nil {
 			return err
 		}
@@ -97,7 +131,15 @@ func runOAuth1(cmd *commander.Command, args []string) error {
 		fmt.Println("verify access with", commandName(), "auth CODE")
 		return launchBrowser(accessURL)
 	case 1:
-		err := c.verifyAccess(args[0])
+		code := args[0]
+		if strings.HasPrefix(code, "http") {
+			u, err := url.Parse(code)
+			if err != nil {
+				return err
+			}
+			code = u.Query().Get("oauth_verifier")
+		}
+		err := c.verifyAccess(code)
 		if err != nil {
 			return err
 		}
@@ -114,7 +156,12 @@ func newOAuth1Client(c *Config, a *apiconfig.AuthState) (Client, error) {
 		return nil, fmt.Errorf("oauth1 not configured")
 	}
 	cl, err := newOAuth1ClientConcrete(c.OAuth1, a)
-	return cl, err
+	if err != nil {
+		return nil, err
+	}
+	// The signed request is sent with the consumer's client.
+	cl.setHTTPClient(c.sendClient())
+	return cl, nil
 }
 
 type oauth1Client struct {
@@ -137,7 +184,19 @@ func newOAuth1ClientConcrete(config *OAuth1Config, auth *apiconfig.AuthState) (*
 		config: config,
 		auth:   auth,
 	}
-	c.consumer = c.getOAuthConsumer()
+	c.consumer, err = c.getOAuthConsumer()
+	if err != nil {
+		return nil, err
+	}
+	c.setHTTPClient(baseClient)
+	if config.TwoLegged {
+		// An empty token leaves oauth_token out of the signature.
+		c.client, err = c.consumer.MakeHttpClient(&oauth.AccessToken{})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
 	c.accessToken, c.accessTokenTime = c.currentAccessToken()
 	c.requestToken, c.requestTokenTime = c.currentRequestToken()
 	if c.isLoggedIn() {
@@ -184,8 +243,8 @@ func (c *oauth1Client) resetAuth() error {
 	return c.auth.Save()
 }
 
-func (c *oauth1Client) requestAccess() (accessURL string, err error) {
-	c.requestToken, accessURL, err = c.consumer.GetRequestTokenAndUrl("oob")
+func (c *oauth1Client) requestAccess(callbackURL string) (accessURL string, err error) {
+	c.requestToken, accessURL, err = c.consumer.GetRequestTokenAndUrl(callbackURL)
 	if err != nil {
 		return "", err
 	}
@@ -241,22 +300,104 @@ func (c *oauth1Client) verifyAccess(code string) error {
 	return err
 }
 
-func (c *oauth1Client) getOAuthConsumer() *oauth.Consumer {
-	oc := oauth.NewConsumer(
-		c.config.ConsumerKey,
-		c.config.ConsumerSecret,
-		oauth.ServiceProvider{
-			RequestTokenUrl:   c.config.RequestTokenURL,
-			AuthorizeTokenUrl: c.config.AuthorizeTokenURL,
-			AccessTokenUrl:    c.config.AccessTokenURL,
-			HttpMethod:        c.config.HttpMethod,
-			BodyHash:          c.config.BodyHash,
-			IgnoreTimestamp:   c.config.IgnoreTimestamp,
-			SignQueryParams:   c.config.SignQueryParams,
-		})
+func (c *oauth1Client) getOAuthConsumer() (*oauth.Consumer, error) {
+	sp := oauth.ServiceProvider{
+		RequestTokenUrl:   c.config.RequestTokenURL,
+		AuthorizeTokenUrl: c.config.AuthorizeTokenURL,
+		AccessTokenUrl:    c.config.AccessTokenURL,
+		HttpMethod:        c.config.HttpMethod,
+		BodyHash:          c.config.BodyHash,
+		IgnoreTimestamp:   c.config.IgnoreTimestamp,
+		SignQueryParams:   c.config.SignQueryParams,
+	}
+	var oc *oauth.Consumer
+	switch strings.ToUpper(c.config.SignatureMethod) {
+	case "", "HMAC-SHA1", "PLAINTEXT":
+		// PLAINTEXT signatures replace HMAC-SHA1 ones in plaintextTransport.
+		oc = oauth.NewConsumer(c.config.ConsumerKey, c.config.ConsumerSecret, sp)
+	case "HMAC-SHA256":
+		oc = oauth.NewCustomConsumer(c.config.ConsumerKey, c.config.ConsumerSecret, crypto.SHA256, sp, nil)
+	case "RSA-SHA1", "RSA-SHA256":
+		if c.config.PrivateKey == "" {
+			return nil, fmt.Errorf("oauth1 %s needs a PrivateKey", c.config.SignatureMethod)
+		}
+		key, err := parsePrivateKey(c.config.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("oauth1 PrivateKey: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("oauth1 PrivateKey is not an RSA key")
+		}
+		hash := crypto.SHA1
+		if strings.HasSuffix(strings.ToUpper(c.config.SignatureMethod), "SHA256") {
+			hash = crypto.SHA256
+		}
+		oc = oauth.NewCustomRSAConsumer(c.config.ConsumerKey, rsaKey, hash, sp, nil)
+	default:
+		return nil, fmt.Errorf("unknown oauth1 SignatureMethod %s", c.config.SignatureMethod)
+	}
 	oc.AdditionalParams = c.config.AdditionalParams
 	oc.AdditionalAuthorizationUrlParams = c.config.AdditionalAuthorizationURLParams
-	return oc
+	return oc, nil
+}
+
+// setHTTPClient sets the client the consumer sends signed requests with.
+func (c *oauth1Client) setHTTPClient(hc *http.Client) {
+	if !strings.EqualFold(c.config.SignatureMethod, "PLAINTEXT") {
+		c.consumer.HttpClient = hc
+		return
+	}
+	c.consumer.HttpClient = &http.Client{
+		Transport: plaintextTransport{client: c, base: hc},
+		// hc follows redirects.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// plaintextTransport replaces the HMAC-SHA1 signature in a request's
+// OAuth Authorization header with a PLAINTEXT one,
+// since the oauth package doesn't support PLAINTEXT.
+type plaintextTransport struct {
+	client *oauth1Client
+	base   *http.Client
+}
+
+func (t plaintextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "OAuth ") {
+		return t.base.Do(req)
+	}
+	params := parseAuthParams(strings.TrimPrefix(h, "OAuth "))
+	token, _ := url.PathUnescape(params["oauth_token"])
+	var tokenSecret string
+	switch {
+	case token == "":
+	case t.client.accessToken != nil && token == t.client.accessToken.Token:
+		tokenSecret = t.client.accessToken.Secret
+	case t.client.requestToken != nil && token == t.client.requestToken.Token:
+		tokenSecret = t.client.requestToken.Secret
+	}
+	params["oauth_signature_method"] = "PLAINTEXT"
+	params["oauth_signature"] = percentEncode(percentEncode(t.client.config.ConsumerSecret) + "&" + percentEncode(tokenSecret))
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("OAuth ")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", k, params[k])
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", b.String())
+	return t.base.Do(req)
 }
 
 func (c *oauth1Client) currentAccessToken() (*oauth.AccessToken, time.Time) {
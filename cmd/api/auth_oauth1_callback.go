@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long the auth command waits for the provider's redirect.
+const oauth1CallbackTimeout = 10 * time.Minute
+
+// authWithCallback does the authorization step with a local listener
+// at CallbackURL, falling back to the paste-the-code path
+// if it can't listen there.
+func (c *oauth1Client) authWithCallback(ctx context.Context) error {
+	u, err := url.Parse(c.config.CallbackURL)
+	if err != nil {
+		return fmt.Errorf("oauth1 CallbackURL: %w", err)
+	}
+	if u.Scheme != "http" || !isLoopbackHost(u.Hostname()) {
+		return fmt.Errorf("oauth1 CallbackURL must be an http URL on localhost")
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		fmt.Println("can't listen for callback:", err)
+		accessURL, err := c.requestAccess("oob")
+		if err != nil {
+			return err
+		}
+		fmt.Println("URL:", accessURL)
+		fmt.Println("verify access with", commandName(), "auth CODE")
+		return launchBrowser(accessURL)
+	}
+	defer l.Close()
+
+	accessURL, err := c.requestAccess(c.config.CallbackURL)
+	if err != nil {
+		return err
+	}
+	verifiers := make(chan string, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != u.Path && u.Path != "" {
+				http.NotFound(w, r)
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("oauth_token") != c.requestToken.Token || q.Get("oauth_verifier") == "" {
+				http.Error(w, "missing or unexpected oauth_token or oauth_verifier", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, "Authorization received. You may close this window.")
+			select {
+			case verifiers <- q.Get("oauth_verifier"):
+			default:
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	fmt.Println("URL:", accessURL)
+	fmt.Println("waiting for callback at", c.config.CallbackURL)
+	fmt.Println("or verify access with", commandName(), "auth CODE")
+	err = launchBrowser(accessURL)
+	if err != nil {
+		fmt.Println("can't launch browser:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oauth1CallbackTimeout)
+	defer cancel()
+	select {
+	case v := <-verifiers:
+		err = c.verifyAccess(v)
+		if err != nil {
+			return err
+		}
+		fmt.Println("success")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no callback received: %w", ctx.Err())
+	}
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -18,27 +26,53 @@ import (
 )
 
 type OAuth2Config struct {
-	GrantType string // AuthorizationCode (default), ClientCredentials, PasswordCredentials
+	GrantType string // AuthorizationCode (default), ClientCredentials, PasswordCredentials, DeviceCode, JWTBearer, TokenExchange
 
 	// Used by all grant types
+	Issuer         string // OpenID Provider; fills in blank endpoint URLs by discovery
 	ClientID       string
 	ClientSecret   string
 	Scopes         []string
 	TokenURL       string
 	TokenURLParams url.Values
-	AuthStyle      string // AutoDetect (default), InParams, InHeader
+	AuthStyle      string // AutoDetect (default), InParams, InHeader, PrivateKeyJWT
 	TokenType      string // empty is the same as "Bearer"
+	DPoP           bool   // bind tokens to a key with RFC 9449 proofs
 
 	// Used by GrantType == AuthorizationCode
 	UsePKCE       bool
 	RedirectURL   string
 	AuthURL       string
 	AuthURLParams url.Values
-	State         string // defaults to "state" if blank
+	State         string // random per attempt if blank
 
 	// Used by GrantType == PasswordCredentials
 	Username string
 	Password string
+
+	// Used by GrantType == DeviceCode
+	DeviceAuthURL string
+
+	// Used by auth revoke, auth introspect and userinfo
+	RevocationURL    string // RFC 7009
+	IntrospectionURL string // RFC 7662
+	UserinfoURL      string // OpenID Connect
+
+	// Used by GrantType == JWTBearer and AuthStyle == PrivateKeyJWT
+	JWTSigningKey string   // PEM private key: RSA for RS256, EC P-256 for ES256
+	JWTKeyID      string   // optional "kid" header
+	JWTIssuer     string   // defaults to ClientID
+	JWTSubject    string   // defaults to JWTIssuer
+	JWTAudience   string   // defaults to TokenURL
+	JWTLifetime   duration // defaults to 5 minutes
+
+	// Used by GrantType == TokenExchange.
+	// The subject token comes from the first of these that is set.
+	// Audience, resource and the like can go in TokenURLParams.
+	SubjectToken        string   // the token itself, usually a reference
+	SubjectTokenCommand []string // a command that prints the token
+	SubjectTokenConfig  string   // API name of another oauth2 config whose access token is used
+	SubjectTokenType    string   // defaults to urn:ietf:params:oauth:token-type:access_token
 }
 
 func (c *OAuth2Config) deref() (*OAuth2Config, error) {
@@ -46,6 +80,7 @@ func (c *OAuth2Config) deref() (*OAuth2Config, error) {
 	return &OAuth2Config{
 		GrantType: deref.String(c.GrantType),
 
+		Issuer:         deref.String(c.Issuer),
 		ClientID:       deref.String(c.ClientID),
 		ClientSecret:   deref.String(c.ClientSecret),
 		Scopes:         deref.StringSlice(c.Scopes),
@@ -53,6 +88,7 @@ func (c *OAuth2Config) deref() (*OAuth2Config, error) {
 		TokenURLParams: deref.URLValues(c.TokenURLParams),
 		AuthStyle:      deref.String(c.AuthStyle),
 		TokenType:      deref.String(c.TokenType),
+		DPoP:           c.DPoP,
 
 		UsePKCE:       c.UsePKCE,
 		RedirectURL:   deref.String(c.RedirectURL),
@@ -62,12 +98,30 @@ func (c *OAuth2Config) deref() (*OAuth2Config, error) {
 
 		Username: deref.String(c.Username),
 		Password: deref.String(c.Password),
+
+		DeviceAuthURL: deref.String(c.DeviceAuthURL),
+
+		RevocationURL:    deref.String(c.RevocationURL),
+		IntrospectionURL: deref.String(c.IntrospectionURL),
+		UserinfoURL:      deref.String(c.UserinfoURL),
+
+		JWTSigningKey: deref.String(c.JWTSigningKey),
+		JWTKeyID:      deref.String(c.JWTKeyID),
+		JWTIssuer:     deref.String(c.JWTIssuer),
+		JWTSubject:    deref.String(c.JWTSubject),
+		JWTAudience:   deref.String(c.JWTAudience),
+		JWTLifetime:   c.JWTLifetime,
+
+		SubjectToken:        deref.String(c.SubjectToken),
+		SubjectTokenCommand: deref.StringSlice(c.SubjectTokenCommand),
+		SubjectTokenConfig:  deref.String(c.SubjectTokenConfig),
+		SubjectTokenType:    deref.String(c.SubjectTokenType),
 	}, deref.Error
 }
 
 func (c *OAuth2Config) authStyle() oauth2.AuthStyle {
 	switch c.AuthStyle {
-	case "InParams":
+	case "InParams", "PrivateKeyJWT":
 		return oauth2.AuthStyleInParams
 	case "InHeader":
 		return oauth2.AuthStyleInHeader
@@ -78,24 +132,58 @@ func (c *OAuth2Config) authStyle() oauth2.AuthStyle {
 	}
 }
 
-var oauth2Commands = []*commander.Command{
-	{
-		UsageLine: "auth [-reset] [verification code or url]",
-		Short:     "do OAuth 2.0 authorization",
-		Flag:      *flag.NewFlagSet("auth", flag.ExitOnError),
-		Run:       runOAuth2,
-	},
+func newOAuth2Commands() []*commander.Command {
+	cmds := []*commander.Command{
+		{
+			UsageLine: "auth [-reset] [verification code or url]",
+			Short:     "do OAuth 2.0 authorization",
+			Flag:      *flag.NewFlagSet("auth", flag.ExitOnError),
+			Run:       runOAuth2,
+			Subcommands: []*commander.Command{
+				{
+					UsageLine: "introspect [-refresh]",
+					Short:     "ask the server about the current token",
+					Flag:      *flag.NewFlagSet("introspect", flag.ExitOnError),
+					Run:       runOAuth2Introspect,
+				},
+				{
+					UsageLine: "revoke",
+					Short:     "revoke tokens with the server and forget them",
+					Run:       runOAuth2Revoke,
+				},
+				{
+					UsageLine: "status",
+					Short:     "show the state of OAuth 2.0 authorization",
+					Run:       runOAuth2Status,
+				},
+			},
+		},
+		{
+			UsageLine: "userinfo",
+			Short:     "show OpenID Connect user info for the current token",
+			Run:       runOAuth2Userinfo,
+		},
+	}
+	cmds[0].Flag.Bool("reset", false, "ignore existing credentials and start over")
+	cmds[0].Subcommands[0].Flag.Bool("refresh", false, "introspect the refresh token instead of the access token")
+	return cmds
 }
 
-func init() {
-	oauth2Commands[0].Flag.Bool("reset", false, "ignore existing credentials and start over")
+// currentOAuth2Client returns the client for cmd's config.
+func currentOAuth2Client(cmd *commander.Command) (*oauth2Client, error) {
+	cfg := commandConfig(cmd)
+	if cfg.OAuth2 == nil {
+		return nil, fmt.Errorf("oauth2 not configured")
+	}
+	state, err := cfg.typeState("oauth2")
+	if err != nil {
+		return nil, err
+	}
+	return newOAuth2ClientConcrete(cfg, state)
 }
 
 func runOAuth2(cmd *commander.Command, args []string) error {
-	if config.OAuth2 == nil {
-		return fmt.Errorf("oauth2 not configured")
-	}
-	c, err := newOAuth2ClientConcrete(config.OAuth2, authState)
+	c, err := currentOAuth2Client(cmd)
 	if err != nil {
 		return err
 	}
@@ -116,21 +204,138 @@ func runOAuth2(cmd *commander.Command, args []string) error {
 	switch c.config.GrantType {
 	case "", "AuthorizationCode":
 		return c.authAuthCode(cmd, args)
-	case "ClientCredentials":
+	case "ClientCredentials", "JWTBearer":
 		return c.authClientCreds(cmd, args)
 	case "PasswordCredentials":
 		return c.authPassword(cmd, args)
+	case "DeviceCode":
+		return c.authDeviceCode(cmd, args)
+	case "TokenExchange":
+		return c.authTokenExchange(cmd, args)
 	default:
 		return fmt.Errorf("unknown OAuth2 grant type: %s", c.config.GrantType)
 	}
 }
 
+func runOAuth2Status(cmd *commander.Command, args []string) error {
+	c, err := currentOAuth2Client(cmd)
+	if err != nil {
+		return err
+	}
+	grantType := c.config.GrantType
+	if grantType == "" {
+		grantType = "AuthorizationCode"
+	}
+	fmt.Println("grant type:", grantType)
+	if len(c.config.Scopes) > 0 {
+		fmt.Println("requested scopes:", strings.Join(c.config.Scopes, " "))
+	}
+	if s := c.auth.Values["Scope"]; s != "" {
+		fmt.Println("granted scopes:", s)
+	}
+	if c.tokenSource == nil || c.tokenSource.t == nil {
+		fmt.Println("access token: none")
+		return nil
+	}
+	t := c.tokenSource.t
+	fmt.Println("access token: present (redacted)")
+	if t.TokenType != "" {
+		fmt.Println("token type:", t.TokenType)
+	}
+	switch {
+	case t.Expiry.IsZero():
+		fmt.Println("expires: never")
+	case t.Expiry.Before(time.Now()):
+		fmt.Println("expires:", t.Expiry.Local().Format(time.RFC3339), "(expired)")
+	default:
+		fmt.Println("expires:", t.Expiry.Local().Format(time.RFC3339),
+			"(in", time.Until(t.Expiry).Round(time.Second).String()+")")
+	}
+	if t.RefreshToken != "" {
+		fmt.Println("refresh token: present (redacted)")
+	} else {
+		fmt.Println("refresh token: none")
+	}
+	return nil
+}
+
+func runOAuth2Revoke(cmd *commander.Command, args []string) error {
+	c, err := currentOAuth2Client(cmd)
+	if err != nil {
+		return err
+	}
+	if c.config.RevocationURL == "" {
+		return fmt.Errorf("missing RevocationURL in oauth2 config")
+	}
+	if t := c.tokenSource.t; t != nil {
+		// Revoking the refresh token should revoke its access tokens too,
+		// but not every server does that.
+		if t.RefreshToken != "" {
+			err := c.revokeToken(cmd.Context(), t.RefreshToken, "refresh_token")
+			if err != nil {
+				return err
+			}
+		}
+		err := c.revokeToken(cmd.Context(), t.AccessToken, "access_token")
+		if err != nil {
+			return err
+		}
+	}
+	err = c.resetAuth()
+	if err != nil {
+		return err
+	}
+	fmt.Println("revoked")
+	return nil
+}
+
+func runOAuth2Introspect(cmd *commander.Command, args []string) error {
+	c, err := currentOAuth2Client(cmd)
+	if err != nil {
+		return err
+	}
+	if c.config.IntrospectionURL == "" {
+		return fmt.Errorf("missing IntrospectionURL in oauth2 config")
+	}
+	t := c.tokenSource.t
+	if t == nil {
+		return fmt.Errorf("not logged in: try %s auth", commandName())
+	}
+	form := url.Values{
+		"token":           {t.AccessToken},
+		"token_type_hint": {"access_token"},
+	}
+	if cmd.Lookup("refresh").(bool) {
+		if t.RefreshToken == "" {
+			return fmt.Errorf("no refresh token")
+		}
+		form.Set("token", t.RefreshToken)
+		form.Set("token_type_hint", "refresh_token")
+	}
+	b, err := c.postForm(cmd.Context(), c.config.IntrospectionURL, form)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, b, "", "\t")
+	if err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
 func newOAuth2Client(c *Config, a *apiconfig.AuthState) (Client, error) {
 	if c.OAuth2 == nil {
 		return nil, fmt.Errorf("oauth2 not configured")
 	}
-	cl, err := newOAuth2ClientConcrete(c.OAuth2, a)
-	return cl, err
+	cl, err := newOAuth2ClientConcrete(c, a)
+	if err != nil {
+		return nil, err
+	}
+	cl.client = c.sendClient()
+	return cl, nil
 }
 
 type oauth2Client struct {
@@ -139,22 +344,60 @@ type oauth2Client struct {
 	acConfig    *oauth2.Config
 	ccConfig    *clientcredentials.Config
 	tokenSource *oauth2TokenSource
+	transport   http.RoundTripper // for requests to the identity provider
+	tokenClient *http.Client      // for token endpoint requests
+	signingKey  crypto.Signer
+	dpop        *dpopSigner
 	client      *http.Client
 }
 
-func newOAuth2ClientConcrete(config *OAuth2Config, auth *apiconfig.AuthState) (*oauth2Client, error) {
-	config, err := config.deref()
+func newOAuth2ClientConcrete(cfg *Config, auth *apiconfig.AuthState) (*oauth2Client, error) {
+	config, err := cfg.OAuth2.deref()
 	if err != nil {
 		return nil, err
 	}
 	c := &oauth2Client{
-		config: config,
-		auth:   auth,
-		client: http.DefaultClient,
+		config:    config,
+		auth:      auth,
+		transport: cfg.netTransport(),
+		client:    cfg.netClient(),
+	}
+	tokenTransport := c.transport
+	if config.JWTSigningKey == "" {
+		switch {
+		case config.GrantType == "JWTBearer":
+			return nil, fmt.Errorf("oauth2 GrantType JWTBearer needs a JWTSigningKey")
+		case config.AuthStyle == "PrivateKeyJWT":
+			return nil, fmt.Errorf("oauth2 AuthStyle PrivateKeyJWT needs a JWTSigningKey")
+		}
+	} else {
+		c.signingKey, err = parsePrivateKey(config.JWTSigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("oauth2 JWTSigningKey: %w", err)
+		}
+		tokenTransport = jwtAssertionTransport{client: c, base: tokenTransport}
+	}
+	// DPoP goes outside, so a retry for a nonce gets fresh assertions,
+	// since servers may reject a reused jti.
+	if config.DPoP {
+		c.dpop, err = loadDPoPSigner(auth)
+		if err != nil {
+			return nil, err
+		}
+		tokenTransport = dpopTransport{signer: c.dpop, base: tokenTransport}
+	}
+	c.tokenClient = cfg.netClient()
+	if c.dpop != nil || c.signingKey != nil {
+		c.tokenClient = &http.Client{Transport: tokenTransport}
+	}
+	if config.Issuer != "" {
+		err = c.discover()
+		if err != nil {
+			return nil, err
+		}
 	}
 	c.translateConfig()
-	c.tokenSource = c.newTokenSource(context.Background(), nil)
-	c.tokenSource.loadToken()
+	c.tokenSource = c.newTokenSource(rootContext, c.storedToken())
 	return c, nil
 }
 
@@ -174,12 +417,20 @@ func (c *oauth2Client) Do(req *http.Request) (*http.Response, error) {
 		}
 		return nil, err
 	}
+	if c.dpop != nil {
+		err = bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		return c.dpop.do(c.client.Do, req, token.AccessToken)
+	}
 	token.SetAuthHeader(req)
 	return c.client.Do(req)
 }
 
 func (c *oauth2Client) translateConfig() {
-	if c.config.GrantType == "ClientCredentials" {
+	switch c.config.GrantType {
+	case "ClientCredentials":
 		c.ccConfig = &clientcredentials.Config{
 			ClientID:       c.config.ClientID,
 			ClientSecret:   c.config.ClientSecret,
@@ -188,16 +439,33 @@ func (c *oauth2Client) translateConfig() {
 			EndpointParams: c.config.TokenURLParams,
 			AuthStyle:      c.config.authStyle(),
 		}
-	} else {
+	case "JWTBearer":
+		// The clientcredentials package allows grant_type to be overridden.
+		// jwtAssertionTransport adds the assertion itself.
+		params := make(url.Values, len(c.config.TokenURLParams)+1)
+		for k, v := range c.config.TokenURLParams {
+			params[k] = v
+		}
+		params.Set("grant_type", jwtBearerGrantType)
+		c.ccConfig = &clientcredentials.Config{
+			ClientID:       c.config.ClientID,
+			ClientSecret:   c.config.ClientSecret,
+			TokenURL:       c.config.TokenURL,
+			Scopes:         c.config.Scopes,
+			EndpointParams: params,
+			AuthStyle:      c.config.authStyle(),
+		}
+	default:
 		c.acConfig = &oauth2.Config{
 			ClientID:     c.config.ClientID,
 			ClientSecret: c.config.ClientSecret,
 			Scopes:       c.config.Scopes,
 			RedirectURL:  c.config.RedirectURL,
 			Endpoint: oauth2.Endpoint{
-				AuthURL:   c.config.AuthURL,
-				TokenURL:  c.config.TokenURL,
-				AuthStyle: c.config.authStyle(),
+				AuthURL:       c.config.AuthURL,
+				DeviceAuthURL: c.config.DeviceAuthURL,
+				TokenURL:      c.config.TokenURL,
+				AuthStyle:     c.config.authStyle(),
 			},
 		}
 	}
@@ -221,7 +489,10 @@ func (c *oauth2Client) authAuthCode(cmd *commander.Command, args []string) error
 				return err
 			}
 			code = u.Query().Get("code")
-			// TODO: check state?
+			err = c.checkState(u.Query().Get("state"))
+			if err != nil {
+				return err
+			}
 			if scopes := u.Query().Get("scope"); scopes != "" {
 				fmt.Println("Scopes:", scopes)
 			}
@@ -239,7 +510,7 @@ func (c *oauth2Client) authAuthCode(cmd *commander.Command, args []string) error
 }
 
 func (c *oauth2Client) authClientCreds(cmd *commander.Command, args []string) error {
-	ctx := cmd.Context()
+	ctx := c.tokenContext(cmd.Context())
 	token, err := c.ccConfig.Token(ctx)
 	if err != nil {
 		return err
@@ -250,19 +521,118 @@ func (c *oauth2Client) authClientCreds(cmd *commander.Command, args []string) er
 }
 
 func (c *oauth2Client) authPassword(cmd *commander.Command, args []string) error {
-	ctx := cmd.Context()
+	ctx := c.tokenContext(cmd.Context())
 	token, err := c.acConfig.PasswordCredentialsToken(ctx, c.config.Username, c.config.Password)
 	if err != nil {
 		return err
 	}
+	err = printIDTokenClaims(token)
+	if err != nil {
+		return err
+	}
 	token.TokenType = c.config.TokenType
 	c.tokenSource = c.newTokenSource(ctx, token)
 	return c.tokenSource.saveToken()
 }
 
+func (c *oauth2Client) authDeviceCode(cmd *commander.Command, args []string) error {
+	ctx := c.tokenContext(cmd.Context())
+	var opts []oauth2.AuthCodeOption
+	for k, vs := range c.config.AuthURLParams {
+		for _, v := range vs {
+			opts = append(opts, oauth2.SetAuthURLParam(k, v))
+		}
+	}
+	da, err := c.acConfig.DeviceAuth(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Println("URL:", da.VerificationURI)
+	fmt.Println("Code:", da.UserCode)
+	if da.VerificationURIComplete != "" {
+		fmt.Println("or visit:", da.VerificationURIComplete)
+	}
+	fmt.Println("waiting for authorization...")
+	var tokenOpts []oauth2.AuthCodeOption
+	for k, vs := range c.config.TokenURLParams {
+		for _, v := range vs {
+			tokenOpts = append(tokenOpts, oauth2.SetAuthURLParam(k, v))
+		}
+	}
+	// DeviceAccessToken polls at the server's interval
+	// and backs off when told to slow_down.
+	token, err := c.acConfig.DeviceAccessToken(ctx, da, tokenOpts...)
+	if err != nil {
+		return err
+	}
+	err = printIDTokenClaims(token)
+	if err != nil {
+		return err
+	}
+	token.TokenType = c.config.TokenType
+	c.tokenSource = c.newTokenSource(ctx, token)
+	err = c.tokenSource.saveToken()
+	if err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+func (c *oauth2Client) revokeToken(ctx context.Context, token, hint string) error {
+	_, err := c.postForm(ctx, c.config.RevocationURL, url.Values{
+		"token":           {token},
+		"token_type_hint": {hint},
+	})
+	return err
+}
+
+// postForm makes a POST request to an authorization server endpoint,
+// authenticating the client as for token requests,
+// and returns the response body.
+func (c *oauth2Client) postForm(ctx context.Context, urlStr string, form url.Values) ([]byte, error) {
+	style := c.config.authStyle()
+	if style == oauth2.AuthStyleInParams {
+		form.Set("client_id", c.config.ClientID)
+		if c.config.ClientSecret != "" {
+			form.Set("client_secret", c.config.ClientSecret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if style != oauth2.AuthStyleInParams {
+		req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+	}
+	resp, err := c.tokenClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return b, fmt.Errorf("%s: HTTP error %s: %s", urlStr, resp.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
 func (c *oauth2Client) resetAuth() error {
 	c.tokenSource = nil
+	old := c.auth.Values
 	c.auth.Values = make(map[string]string)
+	// Keep the key in use by c.dpop, so new tokens are bound to it,
+	// and the cached discovery document, which isn't a credential.
+	for _, k := range []string{"DPoPKey", "OIDCDiscovery", "OIDCDiscoveryDate"} {
+		if v := old[k]; v != "" {
+			c.auth.Values[k] = v
+		}
+	}
 	return c.auth.Save()
 }
 
@@ -276,16 +646,70 @@ func (c *oauth2Client) authCodeURL() (u string, err error) {
 	if c.config.UsePKCE {
 		c.auth.Values["PKCEVerifier"] = oauth2.GenerateVerifier()
 		opts = append(opts, oauth2.S256ChallengeOption(c.auth.Values["PKCEVerifier"]))
-		err = c.auth.Save()
 	}
-	if c.config.State == "" {
-		c.config.State = "state"
+	state := c.config.State
+	if state == "" {
+		state = randomString()
+	}
+	c.auth.Values["State"] = state
+	c.auth.Values["StateDate"] = time.Now().Format(time.RFC3339)
+	if c.wantsIDToken() {
+		c.auth.Values["Nonce"] = randomString()
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", c.auth.Values["Nonce"]))
 	}
-	u = c.acConfig.AuthCodeURL(c.config.State, opts...)
+	err = c.auth.Save()
+	u = c.acConfig.AuthCodeURL(state, opts...)
 	return u, err
 }
 
+// checkState compares the state returned in a redirect URL
+// with the one saved by authCodeURL.
+// Saved state is only good for a few minutes.
+func (c *oauth2Client) checkState(state string) error {
+	want := c.auth.Values["State"]
+	dt, _ := time.Parse(time.RFC3339, c.auth.Values["StateDate"])
+	if want == "" || time.Since(dt) > 10*time.Minute {
+		return fmt.Errorf("authorization attempt expired: try %s auth", commandName())
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(want)) != 1 {
+		return fmt.Errorf("state mismatch in redirect URL: try %s auth", commandName())
+	}
+	return nil
+}
+
+// checkNonce compares the nonce claim of an id_token
+// with the one saved by authCodeURL.
+func (c *oauth2Client) checkNonce(token *oauth2.Token) error {
+	want := c.auth.Values["Nonce"]
+	if want == "" {
+		return nil
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil
+	}
+	claims, err := decodeJWTClaims(idToken)
+	if err != nil {
+		return fmt.Errorf("id_token: %w", err)
+	}
+	nonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(want)) != 1 {
+		return fmt.Errorf("id_token: nonce mismatch")
+	}
+	return nil
+}
+
+func (c *oauth2Client) wantsIDToken() bool {
+	for _, s := range c.config.Scopes {
+		if s == "openid" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *oauth2Client) exchangeCode(ctx context.Context, code string) error {
+	ctx = c.tokenContext(ctx)
 	var opts []oauth2.AuthCodeOption
 	for k, vs := range c.config.TokenURLParams {
 		for _, v := range vs {
@@ -299,11 +723,121 @@ func (c *oauth2Client) exchangeCode(ctx context.Context, code string) error {
 	if err != nil {
 		return err
 	}
+	err = c.checkNonce(token)
+	if err != nil {
+		return err
+	}
+	delete(c.auth.Values, "State")
+	delete(c.auth.Values, "StateDate")
+	delete(c.auth.Values, "Nonce")
+	err = printIDTokenClaims(token)
+	if err != nil {
+		return err
+	}
 	token.TokenType = c.config.TokenType
 	c.tokenSource = c.newTokenSource(ctx, token)
 	return c.tokenSource.saveToken()
 }
 
+// tokenContext returns ctx set up so the oauth2 package
+// makes token endpoint requests with c.tokenClient.
+func (c *oauth2Client) tokenContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, c.tokenClient)
+}
+
+const (
+	jwtBearerGrantType  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	jwtBearerClientType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// jwtAssertion returns a newly signed JWT for use as an RFC 7523 assertion.
+// Client assertions always use the client ID as issuer and subject.
+func (c *oauth2Client) jwtAssertion(forClient bool) (string, error) {
+	if c.signingKey == nil {
+		return "", fmt.Errorf("oauth2 JWTSigningKey not configured")
+	}
+	iss, sub := c.config.JWTIssuer, c.config.JWTSubject
+	if iss == "" || forClient {
+		iss = c.config.ClientID
+	}
+	if sub == "" || forClient {
+		sub = iss
+	}
+	aud := c.config.JWTAudience
+	if aud == "" {
+		aud = c.config.TokenURL
+	}
+	lifetime := time.Duration(c.config.JWTLifetime)
+	if lifetime <= 0 {
+		lifetime = 5 * time.Minute
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"iss": iss,
+		"sub": sub,
+		"aud": aud,
+		"iat": now.Unix(),
+		"exp": now.Add(lifetime).Unix(),
+		"jti": randomString(),
+	}
+	if !forClient && len(c.config.Scopes) > 0 {
+		// Google service accounts want the scopes in the assertion.
+		claims["scope"] = strings.Join(c.config.Scopes, " ")
+	}
+	var header map[string]any
+	if c.config.JWTKeyID != "" {
+		header = map[string]any{"kid": c.config.JWTKeyID}
+	}
+	return signJWT(c.signingKey, header, claims)
+}
+
+// jwtAssertionTransport adds freshly signed assertions
+// to form-encoded token requests:
+// the assertion for the JWT bearer grant,
+// and the client assertion when AuthStyle is PrivateKeyJWT.
+type jwtAssertionTransport struct {
+	client *oauth2Client
+	base   http.RoundTripper
+}
+
+func (t jwtAssertionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return t.base.RoundTrip(req)
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+	if form.Get("grant_type") == jwtBearerGrantType && form.Get("assertion") == "" {
+		assertion, err := t.client.jwtAssertion(false)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("assertion", assertion)
+	}
+	if t.client.config.AuthStyle == "PrivateKeyJWT" {
+		assertion, err := t.client.jwtAssertion(true)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", jwtBearerClientType)
+		form.Set("client_assertion", assertion)
+	}
+	body := form.Encode()
+	req = req.Clone(req.Context())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(body))
+	return t.base.RoundTrip(req)
+}
+
 // This is like oauth2.ReuseTokenSource,
 // but tokens are saved in auth for use across calls of the program.
 type oauth2TokenSource struct {
@@ -315,11 +849,16 @@ type oauth2TokenSource struct {
 }
 
 func (c *oauth2Client) newTokenSource(ctx context.Context, token *oauth2.Token) *oauth2TokenSource {
+	ctx = c.tokenContext(ctx)
 	var ts oauth2.TokenSource
-	if c.config.GrantType == "ClientCredentials" {
+	switch {
+	case c.config.GrantType == "TokenExchange":
+		ts = tokenExchangeSource{ctx: ctx, client: c}
+	case c.ccConfig != nil:
 		ts = c.ccConfig.TokenSource(ctx)
-	} else {
-		ts = c.acConfig.TokenSource(ctx, nil)
+	default:
+		// The token's RefreshToken is used to refresh it.
+		ts = c.acConfig.TokenSource(ctx, token)
 	}
 	return &oauth2TokenSource{
 		auth: c.auth,
@@ -339,31 +878,47 @@ func (s *oauth2TokenSource) Token() (*oauth2.Token, error) {
 		return nil, err
 	}
 	s.t = t
-	return t, s.saveToken()
+	return t, s.saveTokenLocked()
 }
 
 func (s *oauth2TokenSource) saveToken() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.saveTokenLocked()
+}
+
+func (s *oauth2TokenSource) saveTokenLocked() error {
 	s.auth.Values["AccessToken"] = s.t.AccessToken
 	s.auth.Values["TokenType"] = s.t.TokenType
 	s.auth.Values["RefreshToken"] = s.t.RefreshToken
 	s.auth.Values["Expiry"] = s.t.Expiry.Format(time.RFC3339)
+	if scope, ok := s.t.Extra("scope").(string); ok && scope != "" {
+		s.auth.Values["Scope"] = scope
+	}
 	return s.auth.Save()
 }
 
-func (s *oauth2TokenSource) loadToken() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.t = &oauth2.Token{
-		AccessToken:  s.auth.Values["AccessToken"],
-		TokenType:    s.auth.Values["TokenType"],
-		RefreshToken: s.auth.Values["RefreshToken"],
+// storedToken returns the token saved in the auth state, or nil.
+func (c *oauth2Client) storedToken() *oauth2.Token {
+	if c.auth.Values["AccessToken"] == "" {
+		return nil
 	}
-	if x, err := time.Parse(time.RFC3339, s.auth.Values["Expiry"]); err == nil {
-		s.t.Expiry = x
+	t := &oauth2.Token{
+		AccessToken:  c.auth.Values["AccessToken"],
+		TokenType:    c.auth.Values["TokenType"],
+		RefreshToken: c.auth.Values["RefreshToken"],
 	}
-	if s.t.AccessToken == "" {
-		s.t = nil
+	if x, err := time.Parse(time.RFC3339, c.auth.Values["Expiry"]); err == nil {
+		t.Expiry = x
+	}
+	return t
+}
+
+// randomString returns a URL-safe string made from 32 random bytes.
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
+	return base64.RawURLEncoding.EncodeToString(b)
 }
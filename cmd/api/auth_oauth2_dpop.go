@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// dpopSigner makes RFC 9449 DPoP proofs with a key kept in the auth state.
+type dpopSigner struct {
+	key *ecdsa.PrivateKey
+	jwk map[string]any
+
+	mu     sync.Mutex        // guards nonces
+	nonces map[string]string // latest DPoP-Nonce by origin
+}
+
+func loadDPoPSigner(auth *apiconfig.AuthState) (*dpopSigner, error) {
+	var key *ecdsa.PrivateKey
+	if s := auth.Values["DPoPKey"]; s != "" {
+		k, err := parsePrivateKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("DPoPKey: %w", err)
+		}
+		var ok bool
+		key, ok = k.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("DPoPKey: not an EC key")
+		}
+	} else {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		auth.Values["DPoPKey"] = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+		err = auth.Save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.PublicKey.X.FillBytes(x)
+	key.PublicKey.Y.FillBytes(y)
+	return &dpopSigner{
+		key: key,
+		jwk: map[string]any{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		},
+		nonces: make(map[string]string),
+	}, nil
+}
+
+// proof returns a DPoP proof JWT for a request.
+// If accessToken is not blank, the proof is bound to it.
+func (d *dpopSigner) proof(method string, u *url.URL, accessToken string) (string, error) {
+	htu := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	claims := map[string]any{
+		"jti": randomString(),
+		"htm": method,
+		"htu": htu.String(),
+		"iat": time.Now().Unix(),
+	}
+	if nonce := d.nonce(u); nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if accessToken != "" {
+		h := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(h[:])
+	}
+	header := map[string]any{
+		"typ": "dpop+jwt",
+		"jwk": d.jwk,
+	}
+	return signJWT(d.key, header, claims)
+}
+
+func (d *dpopSigner) nonce(u *url.URL) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nonces[u.Scheme+"://"+u.Host]
+}
+
+// setNonce records the server's DPoP-Nonce, reporting whether it changed.
+func (d *dpopSigner) setNonce(u *url.URL, nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	origin := u.Scheme + "://" + u.Host
+	changed := d.nonces[origin] != nonce
+	d.nonces[origin] = nonce
+	return changed
+}
+
+// do sends req with a DPoP proof using send.
+// If accessToken is not blank, it is sent in a DPoP Authorization header.
+// When the server challenges with a new nonce,
+// the request is retried once, so req must have a replayable body.
+func (d *dpopSigner) do(send func(*http.Request) (*http.Response, error), req *http.Request, accessToken string) (*http.Response, error) {
+	for try := 0; ; try++ {
+		r := req.Clone(req.Context())
+		if try > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		p, err := d.proof(r.Method, r.URL, accessToken)
+		if err != nil {
+			if r.Body != nil {
+				r.Body.Close()
+			}
+			return nil, err
+		}
+		r.Header.Set("DPoP", p)
+		if accessToken != "" {
+			r.Header.Set("Authorization", "DPoP "+accessToken)
+		}
+		resp, err := send(r)
+		if err != nil {
+			return resp, err
+		}
+		changed := d.setNonce(r.URL, resp.Header.Get("DPoP-Nonce"))
+		// Token endpoints challenge with 400, resource servers with 401.
+		challenged := resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized
+		if try > 0 || !changed || !challenged || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// dpopTransport adds DPoP proofs to token endpoint requests.
+type dpopTransport struct {
+	signer *dpopSigner
+	base   http.RoundTripper
+}
+
+func (t dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.signer.do(t.base.RoundTrip, req, "")
+}
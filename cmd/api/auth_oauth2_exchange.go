@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gonuts/commander"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+func (c *oauth2Client) authTokenExchange(cmd *commander.Command, args []string) error {
+	ctx := c.tokenContext(cmd.Context())
+	token, err := c.exchangeToken(ctx)
+	if err != nil {
+		return err
+	}
+	token.TokenType = c.config.TokenType
+	c.tokenSource = c.newTokenSource(ctx, token)
+	return c.tokenSource.saveToken()
+}
+
+// exchangeToken gets a new token from the RFC 8693 token exchange grant.
+// The clientcredentials package allows grant_type to be overridden,
+// so it makes the request.
+func (c *oauth2Client) exchangeToken(ctx context.Context) (*oauth2.Token, error) {
+	subjectToken, err := c.subjectToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange subject token: %w", err)
+	}
+	subjectTokenType := c.config.SubjectTokenType
+	if subjectTokenType == "" {
+		subjectTokenType = accessTokenType
+	}
+	params := make(url.Values, len(c.config.TokenURLParams)+3)
+	for k, v := range c.config.TokenURLParams {
+		params[k] = v
+	}
+	params.Set("grant_type", tokenExchangeGrantType)
+	params.Set("subject_token", subjectToken)
+	params.Set("subject_token_type", subjectTokenType)
+	cc := &clientcredentials.Config{
+		ClientID:       c.config.ClientID,
+		ClientSecret:   c.config.ClientSecret,
+		TokenURL:       c.config.TokenURL,
+		Scopes:         c.config.Scopes,
+		EndpointParams: params,
+		AuthStyle:      c.config.authStyle(),
+	}
+	return cc.Token(ctx)
+}
+
+// subjectToken returns the token to be exchanged,
+// from whichever source is configured.
+func (c *oauth2Client) subjectToken(ctx context.Context) (string, error) {
+	switch {
+	case c.config.SubjectToken != "":
+		return c.config.SubjectToken, nil
+	case len(c.config.SubjectTokenCommand) > 0:
+		cmd := exec.CommandContext(ctx, c.config.SubjectTokenCommand[0], c.config.SubjectTokenCommand[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case c.config.SubjectTokenConfig != "":
+		var other Config
+		auth, err := apiconfig.Load(&other, c.config.SubjectTokenConfig)
+		if err != nil {
+			return "", err
+		}
+		if other.OAuth2 == nil {
+			return "", fmt.Errorf("%s: oauth2 not configured", c.config.SubjectTokenConfig)
+		}
+		oc, err := newOAuth2ClientConcrete(&other, auth)
+		if err != nil {
+			return "", err
+		}
+		if oc.tokenSource.t == nil {
+			return "", fmt.Errorf("not logged in: try api -c %s auth", c.config.SubjectTokenConfig)
+		}
+		t, err := oc.tokenSource.Token()
+		if err != nil {
+			return "", err
+		}
+		return t.AccessToken, nil
+	default:
+		return "", fmt.Errorf("no SubjectToken, SubjectTokenCommand or SubjectTokenConfig in oauth2 config")
+	}
+}
+
+// tokenExchangeSource gets new tokens by repeating the exchange.
+type tokenExchangeSource struct {
+	ctx    context.Context
+	client *oauth2Client
+}
+
+func (s tokenExchangeSource) Token() (*oauth2.Token, error) {
+	return s.client.exchangeToken(s.ctx)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gonuts/commander"
+	"golang.org/x/oauth2"
+)
+
+// oidcDiscovery holds the parts of an OpenID Provider's
+// configuration document that we use.
+type oidcDiscovery struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	UserinfoEndpoint            string `json:"userinfo_endpoint"`
+	RevocationEndpoint          string `json:"revocation_endpoint"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint"`
+}
+
+// The discovery document is cached in the auth state for this long.
+const oidcDiscoveryLifetime = 24 * time.Hour
+
+// discover fills in blank endpoint URLs in c.config
+// from the issuer's OpenID configuration.
+func (c *oauth2Client) discover() error {
+	doc, err := c.discoveryDocument()
+	if err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	setDefault := func(dst *string, val string) {
+		if *dst == "" {
+			*dst = val
+		}
+	}
+	setDefault(&c.config.AuthURL, doc.AuthorizationEndpoint)
+	setDefault(&c.config.TokenURL, doc.TokenEndpoint)
+	setDefault(&c.config.DeviceAuthURL, doc.DeviceAuthorizationEndpoint)
+	setDefault(&c.config.UserinfoURL, doc.UserinfoEndpoint)
+	setDefault(&c.config.RevocationURL, doc.RevocationEndpoint)
+	setDefault(&c.config.IntrospectionURL, doc.IntrospectionEndpoint)
+	return nil
+}
+
+func (c *oauth2Client) discoveryDocument() (*oidcDiscovery, error) {
+	var doc oidcDiscovery
+	dt, _ := time.Parse(time.RFC3339, c.auth.Values["OIDCDiscoveryDate"])
+	if raw := c.auth.Values["OIDCDiscovery"]; raw != "" && time.Since(dt) < oidcDiscoveryLifetime {
+		err := json.Unmarshal([]byte(raw), &doc)
+		if err == nil && doc.Issuer == c.config.Issuer {
+			return &doc, nil
+		}
+	}
+	u := strings.TrimSuffix(c.config.Issuer, "/") + "/.well-known/openid-configuration"
+	// Discovery happens when the client is made, so there's no request context.
+	req, err := http.NewRequestWithContext(rootContext, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: c.transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP error %s", u, resp.Status)
+	}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	if doc.Issuer != c.config.Issuer {
+		return nil, fmt.Errorf("%s: issuer %q does not match configured %q", u, doc.Issuer, c.config.Issuer)
+	}
+	c.auth.Values["OIDCDiscovery"] = string(b)
+	c.auth.Values["OIDCDiscoveryDate"] = time.Now().Format(time.RFC3339)
+	return &doc, c.auth.Save()
+}
+
+// printIDTokenClaims shows the claims of the token's id_token, if it has one.
+// The signature is not verified: the token came straight from the token endpoint.
+func printIDTokenClaims(token *oauth2.Token) error {
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil
+	}
+	claims, err := decodeJWTClaims(idToken)
+	if err != nil {
+		return fmt.Errorf("id_token: %w", err)
+	}
+	b, err := json.MarshalIndent(claims, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("id_token claims: %s\n", b)
+	return nil
+}
+
+func runOAuth2Userinfo(cmd *commander.Command, args []string) error {
+	c, err := currentOAuth2Client(cmd)
+	if err != nil {
+		return err
+	}
+	if c.config.UserinfoURL == "" {
+		return fmt.Errorf("missing UserinfoURL or Issuer in oauth2 config")
+	}
+	req, err := http.NewRequestWithContext(cmd.Context(), "GET", c.config.UserinfoURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, b, "", "\t") != nil {
+		// Some providers return a signed JWT instead of JSON.
+		out.Reset()
+		out.Write(bytes.TrimSpace(b))
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
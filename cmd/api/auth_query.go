@@ -15,7 +15,7 @@ func newQueryAuthClient(c *Config, a *apiconfig.AuthState) (Client, error) {
 	}
 	var deref apiconfig.Dereffer
 	return queryAuthClient{
-		Client: http.DefaultClient,
+		Client: c.sendClient(),
 		Config: deref.StringMap(c.QueryAuth),
 	}, deref.Error
 }
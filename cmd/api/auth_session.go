@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gonuts/commander"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// SessionAuthConfig configures logging in with a form
+// that sets a session cookie.
+// The Login and CSRF values are templates executed with sessionTemplateData.
+type SessionAuthConfig struct {
+	Username string
+	Password string
+
+	LoginPageURL string // optional page fetched first, e.g. for a CSRF form field
+	LoginMethod  string // defaults to POST
+	LoginURL     string // relative to the API base URL
+	LoginHeader  map[string]string
+	LoginBody    string
+
+	CSRFHeader string // header that carries the CSRF token
+	CSRFToken  string // template for the token, e.g. {{.Cookies.csrftoken}}
+
+	ExpiredStatus   []int  // statuses meaning the session expired; defaults to 401
+	ExpiredRedirect string // a redirect to a path containing this means the session expired
+}
+
+type sessionTemplateData struct {
+	Username string
+	Password string
+	Page     string            // body of LoginPageURL, or of the login response for CSRFToken
+	Header   http.Header       // headers of the same response
+	Cookies  map[string]string // current session cookies by name
+	Data     map[string]any
+}
+
+func newSessionCommands() []*commander.Command {
+	cmds := []*commander.Command{
+		{
+			UsageLine: "auth [-reset]",
+			Short:     "log in to the API session",
+			Flag:      *flag.NewFlagSet("auth", flag.ExitOnError),
+			Run:       runSessionAuth,
+		},
+	}
+	cmds[0].Flag.Bool("reset", false, "forget the current session and log in again")
+	return cmds
+}
+
+func runSessionAuth(cmd *commander.Command, args []string) error {
+	cfg := commandConfig(cmd)
+	state, err := cfg.typeState("session")
+	if err != nil {
+		return err
+	}
+	cl, err := newSessionClient(cfg, state)
+	if err != nil {
+		return err
+	}
+	c := cl.(*sessionClient)
+	if !cmd.Lookup("reset").(bool) && c.auth.Values["Cookies"] != "" {
+		fmt.Println("session is saved; use -reset to log in again")
+		return nil
+	}
+	err = c.login(cmd.Context())
+	if err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+func newSessionClient(c *Config, a *apiconfig.AuthState) (Client, error) {
+	if c.SessionAuth == nil {
+		return nil, fmt.Errorf("session auth not configured")
+	}
+	if c.SessionAuth.LoginURL == "" {
+		return nil, fmt.Errorf("missing LoginURL in session auth config")
+	}
+	if c.BaseURL == "" {
+		return nil, fmt.Errorf("session auth needs a BaseURL")
+	}
+	var deref apiconfig.Dereffer
+	s := &sessionClient{
+		config:   c.SessionAuth,
+		api:      c,
+		auth:     a,
+		username: deref.String(c.SessionAuth.Username),
+		password: deref.String(c.SessionAuth.Password),
+	}
+	if deref.Error != nil {
+		return nil, deref.Error
+	}
+	var err error
+	s.baseURL, err = url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	s.jar = &sessionJar{}
+	err = s.jar.reset()
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{
+		Transport:     c.sendTransport(),
+		Jar:           s.jar,
+		CheckRedirect: s.checkRedirect,
+	}
+	err = s.loadCookies()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type sessionClient struct {
+	config   *SessionAuthConfig
+	api      *Config
+	auth     *apiconfig.AuthState
+	username string
+	password string
+	baseURL  *url.URL
+	jar      *sessionJar
+	client   *http.Client
+
+	mu sync.Mutex // guards auth.Values, and serializes logins
+}
+
+// sessionJar is a cookie jar that login can empty
+// while other requests are using it.
+type sessionJar struct {
+	mu  sync.Mutex
+	jar *cookiejar.Jar
+}
+
+func (j *sessionJar) current() *cookiejar.Jar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jar
+}
+
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.current().SetCookies(u, cookies)
+}
+
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.current().Cookies(u)
+}
+
+// reset replaces the jar's cookies with none.
+func (j *sessionJar) reset() error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.jar = jar
+	j.mu.Unlock()
+	return nil
+}
+
+func (c *sessionClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	loggedIn := c.auth.Values["Cookies"] != ""
+	c.mu.Unlock()
+	if !loggedIn {
+		err := c.login(req.Context())
+		if err != nil {
+			if req.Body != nil {
+				// http.Client.Do guarantees close, even on error.
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	c.setCSRF(req)
+	resp, err := c.client.Do(req)
+	if err != nil || !c.expired(resp) {
+		if err == nil {
+			err = c.saveCookies()
+		}
+		return resp, err
+	}
+	resp.Body.Close()
+	err = c.login(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	if req.GetBody != nil {
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.setCSRF(req)
+	resp, err = c.client.Do(req)
+	if err == nil {
+		err = c.saveCookies()
+	}
+	return resp, err
+}
+
+func (c *sessionClient) setCSRF(req *http.Request) {
+	c.mu.Lock()
+	token := c.auth.Values["CSRFToken"]
+	c.mu.Unlock()
+	if c.config.CSRFHeader != "" && token != "" {
+		req.Header.Set(c.config.CSRFHeader, token)
+	}
+}
+
+// expired reports whether resp shows the session has expired.
+func (c *sessionClient) expired(resp *http.Response) bool {
+	statuses := c.config.ExpiredStatus
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusUnauthorized}
+	}
+	for _, s := range statuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	if c.config.ExpiredRedirect != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return strings.Contains(resp.Header.Get("Location"), c.config.ExpiredRedirect)
+	}
+	return false
+}
+
+// checkRedirect stops at redirects to the login page,
+// so expired can see them.
+func (c *sessionClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.config.ExpiredRedirect != "" && strings.Contains(req.URL.String(), c.config.ExpiredRedirect) {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	return nil
+}
+
+func (c *sessionClient) login(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.jar.reset()
+	if err != nil {
+		return err
+	}
+	delete(c.auth.Values, "Cookies")
+	delete(c.auth.Values, "CSRFToken")
+
+	data := sessionTemplateData{
+		Username: c.username,
+		Password: c.password,
+		Data:     c.api.Data,
+	}
+	if c.config.LoginPageURL != "" {
+		req, err := c.api.newRequest(ctx, "GET", c.config.LoginPageURL, nil)
+		if err != nil {
+			return err
+		}
+		data.Page, data.Header, err = c.fetch(req)
+		if err != nil {
+			return fmt.Errorf("session login page: %w", err)
+		}
+	}
+	data.Cookies = c.cookies()
+
+	var terr error
+	tmpl := func(s string) string {
+		if terr != nil {
+			return ""
+		}
+		s, terr = templateString(s, data)
+		return s
+	}
+	method := tmpl(c.config.LoginMethod)
+	if method == "" {
+		method = "POST"
+	}
+	loginURL := tmpl(c.config.LoginURL)
+	body := tmpl(c.config.LoginBody)
+	header := make(map[string]string, len(c.config.LoginHeader))
+	for k, v := range c.config.LoginHeader {
+		header[k] = tmpl(v)
+	}
+	if terr != nil {
+		return fmt.Errorf("session login: %w", terr)
+	}
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := c.api.newRequest(ctx, method, loginURL, bodyReader)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	data.Page, data.Header, err = c.fetch(req)
+	if err != nil {
+		return fmt.Errorf("session login: %w", err)
+	}
+	data.Cookies = c.cookies()
+	if len(data.Cookies) == 0 {
+		return fmt.Errorf("session login: no session cookie was set")
+	}
+
+	if c.config.CSRFToken != "" {
+		token, err := templateString(c.config.CSRFToken, data)
+		if err != nil {
+			return fmt.Errorf("session CSRFToken: %w", err)
+		}
+		c.auth.Values["CSRFToken"] = strings.TrimSpace(token)
+	}
+	return c.saveCookiesLocked()
+}
+
+// fetch makes a login-related request, returning the body and headers.
+func (c *sessionClient) fetch(req *http.Request) (string, http.Header, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return "", nil, fmt.Errorf("HTTP error %s", resp.Status)
+	}
+	return string(b), resp.Header, nil
+}
+
+func (c *sessionClient) cookies() map[string]string {
+	m := make(map[string]string)
+	for _, ck := range c.jar.Cookies(c.baseURL) {
+		m[ck.Name] = ck.Value
+	}
+	return m
+}
+
+// The jar's cookies for the base URL are kept in the auth state
+// as a JSON object of names and values.
+func (c *sessionClient) saveCookies() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveCookiesLocked()
+}
+
+// saveCookiesLocked is saveCookies, with c.mu held.
+func (c *sessionClient) saveCookiesLocked() error {
+	b, err := json.Marshal(c.cookies())
+	if err != nil {
+		return err
+	}
+	if string(b) == c.auth.Values["Cookies"] {
+		return nil
+	}
+	c.auth.Values["Cookies"] = string(b)
+	return c.auth.Save()
+}
+
+func (c *sessionClient) loadCookies() error {
+	s := c.auth.Values["Cookies"]
+	if s == "" {
+		return nil
+	}
+	var m map[string]string
+	err := json.Unmarshal([]byte(s), &m)
+	if err != nil {
+		return fmt.Errorf("session cookies: %w", err)
+	}
+	cookies := make([]*http.Cookie, 0, len(m))
+	for k, v := range m {
+		cookies = append(cookies, &http.Cookie{Name: k, Value: v, Path: "/"})
+	}
+	c.jar.SetCookies(c.baseURL, cookies)
+	return nil
+}
@@ -22,6 +22,11 @@ type Command struct {
 	Header   map[string]string
 	ReadBody bool
 	Body     string
+
+	Auth  string       // "none", or the name of an AltAuth block
+	Retry *RetryConfig // replaces the config's retry settings
+
+	Timeout *TimeoutConfig // nonzero values replace the config's
 }
 
 type CommandFlag struct {
@@ -84,20 +89,39 @@ func (c *Command) Run(cmd *commander.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	cfg, err := config.withAuth(c.Auth)
+	if err != nil {
+		return err
+	}
+	if c.Retry != nil || c.Timeout != nil {
+		cmdCfg := *cfg
+		if c.Retry != nil {
+			cmdCfg.Retry = c.Retry
+		}
+		if c.Timeout != nil {
+			cmdCfg.Timeout = cfg.Timeout.merge(c.Timeout)
+			// The command gets its own transport, leaving baseTransport alone.
+			cmdCfg.transport, err = cmdCfg.newTransport()
+			if err != nil {
+				return err
+			}
+		}
+		cfg = &cmdCfg
+	}
 	var body io.Reader
 	if c.ReadBody {
 		body = os.Stdin
 	} else if d.Body != "" {
 		body = strings.NewReader(d.Body)
 	}
-	req, err := config.newRequest(cmd.Context(), d.Method, d.URL, body)
+	req, err := cfg.newRequest(cmd.Context(), d.Method, d.URL, body)
 	if err != nil {
 		return err
 	}
 	for k, v := range d.Header {
 		req.Header.Set(k, v)
 	}
-	_, err = config.doRequest(req, os.Stdout)
+	_, err = cfg.doRequest(req, os.Stdout)
 	return err
 }
 
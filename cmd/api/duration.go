@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// duration is a time.Duration read from config as a string
+// like "1m30s", or as a number of seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	s := string(text)
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -11,8 +12,13 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/gonuts/commander"
 
@@ -25,42 +31,97 @@ var cmd = &commander.Command{
 }
 
 var configName = flag.String("c", "", "API name for configuration")
+var timeout = flag.Duration("timeout", 0, "give up on the command after this long, e.g. 30s")
+
+// rootContext is canceled on interrupt or when -timeout passes.
+// Commands get it from cmd.Context; it's here for work
+// that outlives a single request, like token refreshes.
+var rootContext = context.Background()
 
 var config Config
 var authState *apiconfig.AuthState
 
 type Config struct {
-	Auth               string
+	AuthConfig
 	Paging             string
-	BaseURL            string
+	BaseURL            string // may be unix:///path/to/socket:/api/path
+	Socket             string // a Unix domain socket to connect to instead of BaseURL's host
 	DocsURL            string
 	DefaultContentType string
 	UserAgent          string
 
-	BasicAuth  *BasicAuthConfig
-	BearerAuth *BearerAuthConfig
-	OAuth1     *OAuth1Config
-	OAuth2     *OAuth2Config
-	QueryAuth  QueryAuthConfig
+	// Alternate auth blocks, by name, for use by [[Command]] Auth.
+	// Each keeps its state in its own auth file.
+	AltAuth map[string]*AuthConfig
+
+	HTTP      *HTTPConfig
+	TLS       *TLSConfig
+	Timeout   *TimeoutConfig
+	Retry     *RetryConfig
+	RateLimit *RateLimitConfig
 
 	JSONPaging *JSONPagingConfig
 
 	Data map[string]any
 
 	Command []*Command
+
+	next      Client               // where the auth type being built sends requests
+	authState *apiconfig.AuthState // if not the global authState
+	transport http.RoundTripper    // if not baseTransport
+}
+
+// AuthConfig is the part of Config that chooses and configures authorization.
+type AuthConfig struct {
+	Auth any // an auth type, or a list of them layered in order
+
+	AWSSigV4    *AWSSigV4Config
+	BasicAuth   *BasicAuthConfig
+	BearerAuth  *BearerAuthConfig
+	DigestAuth  *BasicAuthConfig
+	HeaderAuth  HeaderAuthConfig
+	HMACAuth    *HMACAuthConfig
+	HTTPSig     *HTTPSigConfig
+	OAuth1      *OAuth1Config
+	OAuth2      *OAuth2Config
+	QueryAuth   QueryAuthConfig
+	SessionAuth *SessionAuthConfig
 }
 
 var authTypeClients = map[string]func(*Config, *apiconfig.AuthState) (Client, error){
-	"basic":  newBasicAuthClient,
-	"bearer": newBearerAuthClient,
-	"oauth1": newOAuth1Client,
-	"oauth2": newOAuth2Client,
-	"query":  newQueryAuthClient,
+	"aws-sigv4": newAWSSigV4Client,
+	"basic":     newBasicAuthClient,
+	"bearer":    newBearerAuthClient,
+	"digest":    newDigestAuthClient,
+	"header":    newHeaderAuthClient,
+	"hmac":      newHMACAuthClient,
+	"httpsig":   newHTTPSigClient,
+	"oauth1":    newOAuth1Client,
+	"oauth2":    newOAuth2Client,
+	"query":     newQueryAuthClient,
+	"session":   newSessionClient,
+}
+
+var authCommands = map[string]func() []*commander.Command{
+	"httpsig": newHTTPSigCommands,
+	"oauth1":  newOAuth1Commands,
+	"oauth2":  newOAuth2Commands,
+	"session": newSessionCommands,
 }
 
-var authCommands = map[string][]*commander.Command{
-	"oauth1": oauth1Commands,
-	"oauth2": oauth2Commands,
+// altAuthCommands maps the command grouping each AltAuth block's
+// auth commands to the Config they act on.
+var altAuthCommands = map[*commander.Command]*Config{}
+
+// commandConfig returns the Config an auth command acts on:
+// its AltAuth block's, or the main config.
+func commandConfig(cmd *commander.Command) *Config {
+	for ; cmd != nil; cmd = cmd.Parent {
+		if c, ok := altAuthCommands[cmd]; ok {
+			return c
+		}
+	}
+	return &config
 }
 
 var pagingCommands = map[string][]*commander.Command{
@@ -84,12 +145,25 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	err = config.setupTransport()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 	err = config.addCommands(cmd)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
-	err = cmd.Dispatch(context.Background(), flag.Args())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cancel := func() {}
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	rootContext = ctx
+	err = cmd.Dispatch(ctx, flag.Args())
+	cancel()
+	stop()
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
@@ -108,39 +182,316 @@ func launchBrowser(urlStr string) error {
 }
 
 func (c *Config) addCommands(cmd *commander.Command) error {
+	// The request commands and the config's own come first.
+	// Built-in commands named like one of them are left out,
+	// so a config's commands aren't shadowed by new built-ins.
+	taken := make(map[string]bool)
+	subs := append(defaultCommands, c.Command...)
+	for _, s := range subs {
+		sub, err := s.Commander()
+		if err != nil {
+			return err
+		}
+		cmd.Subcommands = append(cmd.Subcommands, sub)
+		taken[sub.Name()] = true
+	}
+	add := func(cmds ...*commander.Command) {
+		for _, sub := range cmds {
+			if !taken[sub.Name()] {
+				cmd.Subcommands = append(cmd.Subcommands, sub)
+				taken[sub.Name()] = true
+			}
+		}
+	}
+
 	if config.DocsURL != "" {
-		cmd.Subcommands = append(cmd.Subcommands, docsCommand)
+		add(docsCommand)
 	}
-	if cmds := authCommands[c.Auth]; cmds != nil {
-		cmd.Subcommands = append(cmd.Subcommands, cmds...)
+	cmds, err := c.authSubcommands()
+	if err != nil {
+		return err
 	}
+	add(cmds...)
 	if cmds := pagingCommands[c.Paging]; cmds != nil {
-		cmd.Subcommands = append(cmd.Subcommands, cmds...)
+		add(cmds...)
 	}
-	subs := append(defaultCommands, c.Command...)
-	for _, s := range subs {
-		sub, err := s.Commander()
+	add(tokenCommand, execCommand, proxyCommand)
+	names := make([]string, 0, len(c.AltAuth))
+	for name := range c.AltAuth {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		alt, err := c.withAuth(name)
 		if err != nil {
 			return err
 		}
-		cmd.Subcommands = append(cmd.Subcommands, sub)
+		cmds, err := alt.authSubcommands()
+		if err != nil {
+			return err
+		}
+		if len(cmds) == 0 {
+			continue
+		}
+		group := &commander.Command{
+			UsageLine:   name + " command",
+			Short:       "auth commands for AltAuth " + name,
+			Subcommands: cmds,
+		}
+		altAuthCommands[group] = alt
+		add(group)
 	}
 	return nil
 }
 
+// authSubcommands returns the auth commands for c's auth types.
+func (c *Config) authSubcommands() ([]*commander.Command, error) {
+	types, err := c.authTypes()
+	if err != nil {
+		return nil, err
+	}
+	var withCommands []string
+	for _, t := range types {
+		if authCommands[t] != nil {
+			withCommands = append(withCommands, t)
+		}
+	}
+	var cmds []*commander.Command
+	for _, t := range withCommands {
+		tcmds := authCommands[t]()
+		if len(withCommands) > 1 {
+			// Several types have an auth command,
+			// so each type's commands go under its own name.
+			tcmds = []*commander.Command{{
+				UsageLine:   t + " command",
+				Short:       t + " auth commands",
+				Subcommands: tcmds,
+			}}
+		}
+		cmds = append(cmds, tcmds...)
+	}
+	return cmds, nil
+}
+
 type Client interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
+// httpClients caches the clients built by httpClient, since
+// auth types like digest keep state between requests.
+var httpClients struct {
+	sync.Mutex
+	m map[*Config]Client
+}
+
+// httpClient layers the clients of the configured auth types.
+// Each passes its requests to the next, and the last sends them.
+// Requests are rate limited first, if configured.
+// The client is built once for each Config.
 func (c *Config) httpClient() (Client, error) {
-	if c.Auth == "" {
-		return http.DefaultClient, nil
+	httpClients.Lock()
+	defer httpClients.Unlock()
+	if cl, ok := httpClients.m[c]; ok {
+		return cl, nil
+	}
+	cl, err := c.authClient(nil)
+	if err != nil {
+		return nil, err
+	}
+	cl, err = c.wrapRateLimit(cl)
+	if err != nil {
+		return nil, err
+	}
+	if httpClients.m == nil {
+		httpClients.m = make(map[*Config]Client)
 	}
-	fn, ok := authTypeClients[c.Auth]
+	httpClients.m[c] = cl
+	return cl, nil
+}
+
+// authClient is httpClient, with the last auth type
+// sending its requests to last instead of netClient, if last is not nil.
+func (c *Config) authClient(last Client) (Client, error) {
+	types, err := c.authTypes()
+	if err != nil {
+		return nil, err
+	}
+	// HeaderAuth combines with any other auth type.
+	if c.HeaderAuth != nil && !containsString(types, "header") {
+		types = append([]string{"header"}, types...)
+	}
+	next := last
+	for i := len(types) - 1; i >= 0; i-- {
+		fn, ok := authTypeClients[types[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown authorization type: %s", types[i])
+		}
+		state, err := c.typeState(types[i])
+		if err != nil {
+			return nil, err
+		}
+		layer := *c
+		layer.next = next
+		next, err = fn(&layer, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if next == nil {
+		return c.netClient(), nil
+	}
+	return next, nil
+}
+
+// statefulAuthTypes are the auth types that keep values in the auth state.
+var statefulAuthTypes = []string{"oauth1", "oauth2", "session"}
+
+// typeStates holds the auth states loaded by typeState, by file name.
+var typeStates = map[string]*apiconfig.AuthState{}
+
+// typeState returns the auth state for the given auth type.
+// When more than one layered type keeps state, each keeps it
+// in its own file, so that their values don't collide.
+func (c *Config) typeState(typ string) (*apiconfig.AuthState, error) {
+	state := authState
+	if c.authState != nil {
+		state = c.authState
+	}
+	types, err := c.authTypes()
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, t := range types {
+		if containsString(statefulAuthTypes, t) {
+			n++
+		}
+	}
+	if n < 2 || state == nil || !containsString(statefulAuthTypes, typ) {
+		return state, nil
+	}
+	name := strings.TrimSuffix(state.FileName, ".auth") + "-" + typ + ".auth"
+	if s, ok := typeStates[name]; ok {
+		return s, nil
+	}
+	s := &apiconfig.AuthState{
+		FileName: name,
+		Values:   make(map[string]string),
+	}
+	err = s.Load()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	typeStates[name] = s
+	return s, nil
+}
+
+// withAuth returns a copy of c using the named AltAuth block,
+// or no auth if name is "none". A blank name returns c.
+func (c *Config) withAuth(name string) (*Config, error) {
+	switch name {
+	case "":
+		return c, nil
+	case "none":
+		alt := *c
+		alt.AuthConfig = AuthConfig{}
+		return &alt, nil
+	}
+	a, ok := c.AltAuth[name]
 	if !ok {
-		return nil, fmt.Errorf("unknown authorization type: %s", c.Auth)
+		return nil, fmt.Errorf("no AltAuth named %s", name)
+	}
+	alt := *c
+	alt.AuthConfig = *a
+	alt.authState = &apiconfig.AuthState{
+		FileName: strings.TrimSuffix(authState.FileName, ".auth") + "-" + name + ".auth",
+		Values:   make(map[string]string),
+	}
+	err := alt.authState.Load()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", alt.authState.FileName, err)
+	}
+	return &alt, nil
+}
+
+func (c *Config) authTypes() ([]string, error) {
+	switch a := c.Auth.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if a == "" {
+			return nil, nil
+		}
+		return []string{a}, nil
+	case []any:
+		types := make([]string, len(a))
+		for i, t := range a {
+			s, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("Auth: %v is not an auth type name", t)
+			}
+			types[i] = s
+		}
+		return types, nil
+	}
+	return nil, fmt.Errorf("Auth must be a string or list of strings")
+}
+
+// netClient is the client that sends c's requests over the network.
+func (c *Config) netClient() *http.Client {
+	if c.transport == nil {
+		return baseClient
+	}
+	return &http.Client{Transport: c.transport}
+}
+
+// netTransport is the transport that sends c's requests over the network.
+func (c *Config) netTransport() http.RoundTripper {
+	if c.transport == nil {
+		return baseTransport
+	}
+	return c.transport
+}
+
+// sendClient is the client an auth type uses to send API requests:
+// the next auth type in the chain, or netClient.
+func (c *Config) sendClient() *http.Client {
+	if c.next == nil {
+		return c.netClient()
+	}
+	return &http.Client{
+		Transport: c.sendTransport(),
+		// The last client in the chain follows redirects.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (c *Config) sendTransport() http.RoundTripper {
+	if c.next == nil {
+		return c.netTransport()
 	}
-	return fn(c, authState)
+	return clientTransport{c.next}
+}
+
+// clientTransport adapts a Client for use as an http.RoundTripper.
+type clientTransport struct {
+	Client Client
+}
+
+func (t clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request, but Clients do.
+	return t.Client.Do(req.Clone(req.Context()))
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Config) newRequest(ctx context.Context, method, urlStr string, body io.Reader) (*http.Request, error) {
@@ -184,7 +535,12 @@ func (c *Config) doRequest(req *http.Request, out io.Writer) (resp *http.Respons
 	if err != nil {
 		return nil, err
 	}
-	resp, err = client.Do(req)
+	if c.Timeout != nil && c.Timeout.Total > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(c.Timeout.Total))
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	resp, err = c.send(client, req)
 	if err != nil {
 		return resp, err
 	}
@@ -200,6 +556,25 @@ func (c *Config) doRequest(req *http.Request, out io.Writer) (resp *http.Respons
 	return resp, nil
 }
 
+// bufferBody reads req's body into memory, if needed,
+// so the request can be sent more than once.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.GetBody != nil {
+		return nil
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
 var docsCommand = &commander.Command{
 	Run:       runDocs,
 	UsageLine: "docs",
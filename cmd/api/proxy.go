@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gonuts/commander"
+)
+
+var proxyCommand = &commander.Command{
+	Run:       runProxy,
+	UsageLine: "proxy [-listen addr] [-methods list] [-paths list]",
+	Short:     "serve a local proxy to the API that adds its auth",
+	Long: `
+Proxy listens for HTTP requests and forwards them to the API,
+relative to the base URL, with the configured auth.
+Each request is logged to standard error.
+
+The -methods and -paths flags take comma-separated lists
+restricting which requests are forwarded, for example
+-methods GET,HEAD for read-only access.
+Paths are prefixes, relative to the base URL.
+
+Only requests for the base URL's host are forwarded, and only
+from clients addressing the proxy by IP address or localhost.
+`,
+	Flag: *flag.NewFlagSet("proxy", flag.ExitOnError),
+}
+
+func init() {
+	proxyCommand.Flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	proxyCommand.Flag.String("methods", "", "comma-separated methods to allow (default all)")
+	proxyCommand.Flag.String("paths", "", "comma-separated path prefixes to allow (default all)")
+}
+
+func runProxy(cmd *commander.Command, args []string) error {
+	if config.BaseURL == "" {
+		return fmt.Errorf("proxy needs a BaseURL")
+	}
+	client, err := config.httpClient()
+	if err != nil {
+		return err
+	}
+	addr := cmd.Lookup("listen").(string)
+	p := &apiProxy{
+		listen:  addr,
+		methods: splitList(strings.ToUpper(cmd.Lookup("methods").(string))),
+		paths:   splitList(cmd.Lookup("paths").(string)),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director:  p.direct,
+		Transport: clientTransport{client},
+		ErrorLog:  log.Default(),
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		<-cmd.Context().Done()
+		srv.Close()
+	}()
+	log.Printf("proxying http://%s/ to %s", addr, config.BaseURL)
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+type apiProxy struct {
+	proxy   *httputil.ReverseProxy
+	listen  string
+	methods []string
+	paths   []string
+}
+
+func (p *apiProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	_, targetErr := proxyTarget(r)
+	switch {
+	case !p.allowedHost(r.Host):
+		// Only names for the listen address, so a web page
+		// can't reach the proxy through DNS rebinding.
+		http.Error(lw, "forbidden host", http.StatusForbidden)
+	case targetErr != nil:
+		http.Error(lw, targetErr.Error(), http.StatusBadRequest)
+	case !p.allowed(r):
+		http.Error(lw, "forbidden by api proxy", http.StatusForbidden)
+	default:
+		p.proxy.ServeHTTP(lw, r)
+	}
+	log.Printf("%s %s %d %s", r.Method, r.URL.RequestURI(), lw.status, time.Since(start).Round(time.Millisecond))
+}
+
+func (p *apiProxy) allowed(r *http.Request) bool {
+	if len(p.methods) > 0 && !containsString(p.methods, r.Method) {
+		return false
+	}
+	if len(p.paths) == 0 {
+		return true
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	for _, prefix := range p.paths {
+		if strings.HasPrefix(path, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHost reports whether host, from a request's Host header,
+// names the address the proxy listens on.
+func (p *apiProxy) allowedHost(host string) bool {
+	if host == p.listen {
+		return true
+	}
+	lhost, lport, err := net.SplitHostPort(p.listen)
+	if err != nil {
+		return false
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, "80"
+	}
+	if port != lport {
+		return false
+	}
+	// Addresses, and localhost, can't be rebound to another server.
+	return h == lhost || h == "localhost" || net.ParseIP(strings.Trim(h, "[]")) != nil
+}
+
+// proxyTarget returns the API URL for a request to the proxy.
+// Paths are relative to the base URL, like those of other commands,
+// and may not lead anywhere else, since the request gets the credentials.
+func proxyTarget(r *http.Request) (*url.URL, error) {
+	if hasDotSegment(r.URL.Path) {
+		// These could escape the allowed paths, or the base URL.
+		return nil, fmt.Errorf("bad path")
+	}
+	rel := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+	if strings.HasPrefix(rel, "/") {
+		// A network-path reference, naming another host.
+		return nil, fmt.Errorf("bad path")
+	}
+	if r.URL.RawQuery != "" {
+		rel += "?" + r.URL.RawQuery
+	}
+	s, err := config.relativeURLString(rel)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(config.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != base.Scheme || u.Host != base.Host {
+		return nil, fmt.Errorf("path leads outside the base URL")
+	}
+	return u, nil
+}
+
+// direct points the outgoing request at the API.
+func (p *apiProxy) direct(req *http.Request) {
+	u, err := proxyTarget(req)
+	if err != nil {
+		// ServeHTTP checked the target, but if it's unusable,
+		// the transport reports it.
+		req.URL.Scheme = ""
+		return
+	}
+	req.URL = u
+	req.Host = ""
+	req.RequestURI = "" // it goes through http.Client.Do
+	// The configured auth supplies the credentials.
+	req.Header.Del("Authorization")
+	req.Header.Del("Cookie")
+	req.Header["X-Forwarded-For"] = nil
+	if config.UserAgent != "" {
+		req.Header.Set("User-Agent", config.UserAgent)
+	}
+}
+
+func hasDotSegment(path string) bool {
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// splitList splits a comma-separated list, ignoring blank items.
+func splitList(s string) []string {
+	var list []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// RateLimitConfig limits requests with a token bucket.
+// Its state is kept in a file beside the auth state,
+// so the limit holds across separate runs of the command.
+type RateLimitConfig struct {
+	Requests float64  // allowed per Per
+	Per      duration // defaults to 1s
+	Burst    int      // bucket size; defaults to Requests
+}
+
+// How long a rate limit lock file can be held before it is presumed stale.
+const rateLimitStaleLock = 10 * time.Second
+
+func (c *Config) wrapRateLimit(next Client) (Client, error) {
+	if c.RateLimit == nil {
+		return next, nil
+	}
+	if c.RateLimit.Requests <= 0 {
+		return nil, fmt.Errorf("RateLimit needs Requests")
+	}
+	state := authState
+	if c.authState != nil {
+		state = c.authState
+	}
+	if state == nil {
+		return nil, fmt.Errorf("RateLimit needs a config file")
+	}
+	per := time.Duration(c.RateLimit.Per)
+	if per <= 0 {
+		per = time.Second
+	}
+	burst := float64(c.RateLimit.Burst)
+	if burst <= 0 {
+		burst = c.RateLimit.Requests
+	}
+	return &rateLimitClient{
+		Client:   next,
+		fileName: strings.TrimSuffix(state.FileName, ".auth") + ".ratelimit",
+		rate:     c.RateLimit.Requests / per.Seconds(),
+		burst:    burst,
+	}, nil
+}
+
+type rateLimitClient struct {
+	Client   Client
+	fileName string
+	rate     float64 // tokens per second
+	burst    float64
+}
+
+func (c *rateLimitClient) Do(req *http.Request) (*http.Response, error) {
+	err := c.wait(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			// http.Client.Do guarantees close, even on error.
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err == nil {
+		c.adapt(resp)
+	}
+	return resp, err
+}
+
+// wait takes a token from the bucket, waiting for one if needed.
+func (c *rateLimitClient) wait(ctx context.Context) error {
+	for {
+		d, err := c.take()
+		if err != nil {
+			return fmt.Errorf("rate limit: %w", err)
+		}
+		if d <= 0 {
+			return nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// take removes a token from the bucket and returns 0,
+// or returns how long to wait before trying again.
+func (c *rateLimitClient) take() (time.Duration, error) {
+	var wait time.Duration
+	err := c.update(func(s *rateLimitState) {
+		now := time.Now()
+		if !s.serverReset.IsZero() {
+			if now.Before(s.serverReset) && s.serverRemaining <= 0 {
+				wait = s.serverReset.Sub(now)
+				return
+			}
+			if !now.Before(s.serverReset) {
+				s.serverReset = time.Time{}
+			}
+		}
+		if s.updated.IsZero() {
+			s.tokens = c.burst
+		} else if elapsed := now.Sub(s.updated).Seconds(); elapsed > 0 {
+			s.tokens += elapsed * c.rate
+		}
+		if s.tokens > c.burst {
+			s.tokens = c.burst
+		}
+		s.updated = now
+		if s.tokens < 1 {
+			wait = time.Duration((1 - s.tokens) / c.rate * float64(time.Second))
+			return
+		}
+		s.tokens--
+		if !s.serverReset.IsZero() {
+			s.serverRemaining--
+		}
+	})
+	return wait, err
+}
+
+// adapt records the server's view of the limit from response headers:
+// X-RateLimit-Remaining and -Reset, RateLimit-Remaining and -Reset,
+// or a combined RateLimit header.
+func (c *rateLimitClient) adapt(resp *http.Response) {
+	remaining := firstHeader(resp.Header, "RateLimit-Remaining", "X-RateLimit-Remaining")
+	reset := firstHeader(resp.Header, "RateLimit-Reset", "X-RateLimit-Reset")
+	if v := resp.Header.Get("RateLimit"); v != "" && remaining == "" {
+		for _, part := range strings.Split(v, ",") {
+			k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch strings.ToLower(k) {
+			case "remaining", "r":
+				remaining = val
+			case "reset", "t":
+				reset = val
+			}
+		}
+	}
+	n, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return
+	}
+	r, err := strconv.ParseFloat(reset, 64)
+	if err != nil {
+		return
+	}
+	var resetAt time.Time
+	if r > 1e9 {
+		// Some APIs send a Unix time, rather than seconds to wait.
+		resetAt = time.Unix(int64(r), 0)
+	} else {
+		resetAt = time.Now().Add(time.Duration(r * float64(time.Second)))
+	}
+	c.update(func(s *rateLimitState) {
+		s.serverRemaining = n
+		s.serverReset = resetAt
+	})
+}
+
+func firstHeader(h http.Header, names ...string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+type rateLimitState struct {
+	tokens          float64
+	updated         time.Time
+	serverRemaining float64
+	serverReset     time.Time
+}
+
+// update locks the state file, loads the state, applies fn, and saves it.
+func (c *rateLimitClient) update(fn func(*rateLimitState)) error {
+	unlock, err := lockFile(c.fileName + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	a := &apiconfig.AuthState{FileName: c.fileName, Values: make(map[string]string)}
+	err = a.Load()
+	if err != nil {
+		// A damaged state file just starts the bucket over.
+		a.Values = make(map[string]string)
+	}
+	var s rateLimitState
+	s.tokens, _ = strconv.ParseFloat(a.Values["Tokens"], 64)
+	s.updated, _ = time.Parse(time.RFC3339Nano, a.Values["Updated"])
+	s.serverRemaining, _ = strconv.ParseFloat(a.Values["ServerRemaining"], 64)
+	s.serverReset, _ = time.Parse(time.RFC3339Nano, a.Values["ServerReset"])
+	fn(&s)
+	a.Values = map[string]string{
+		"Tokens":  strconv.FormatFloat(s.tokens, 'f', -1, 64),
+		"Updated": s.updated.Format(time.RFC3339Nano),
+	}
+	if !s.serverReset.IsZero() {
+		a.Values["ServerRemaining"] = strconv.FormatFloat(s.serverRemaining, 'f', -1, 64)
+		a.Values["ServerReset"] = s.serverReset.Format(time.RFC3339Nano)
+	}
+	return a.Save()
+}
+
+// lockFile takes an exclusive lock by creating name,
+// returning a function that releases it.
+func lockFile(name string) (func(), error) {
+	deadline := time.Now().Add(2 * rateLimitStaleLock)
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > rateLimitStaleLock {
+			// Left by a process that died holding it.
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryConfig sets when and how failed requests are tried again.
+type RetryConfig struct {
+	MaxAttempts int   // including the first; defaults to 3
+	Statuses    []int // defaults to 429, 502, 503, and 504
+
+	// Errors are the kinds of transport errors to retry:
+	// "timeout", "connection" (refused or reset), or "all".
+	// The default is timeout and connection.
+	Errors []string
+
+	InitialDelay duration // defaults to 500ms
+	MaxDelay     duration // defaults to 30s
+	Multiplier   float64  // defaults to 2
+	Jitter       float64  // fraction of each delay randomized, 0 to 1; defaults to 0.5
+
+	// Retry-After response headers are honored up to this long,
+	// defaulting to 2 minutes. Longer waits are not retried.
+	MaxRetryAfter duration
+
+	// Only idempotent methods are retried unless this is set.
+	AllMethods bool
+}
+
+func (r *RetryConfig) maxAttempts() int {
+	if r == nil {
+		return 1
+	}
+	if r.MaxAttempts <= 0 {
+		return 3
+	}
+	return r.MaxAttempts
+}
+
+// retryable reports whether the method can be retried.
+func (r *RetryConfig) retryable(method string) bool {
+	if r.AllMethods {
+		return true
+	}
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (r *RetryConfig) retryStatus(status int) bool {
+	statuses := r.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		}
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RetryConfig) retryError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	kinds := r.Errors
+	if len(kinds) == 0 {
+		kinds = []string{"timeout", "connection"}
+	}
+	for _, k := range kinds {
+		switch k {
+		case "all":
+			return true
+		case "timeout":
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return true
+			}
+		case "connection":
+			if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+				errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (r *RetryConfig) backoff(retry int) time.Duration {
+	initial, maxDelay := time.Duration(r.InitialDelay), time.Duration(r.MaxDelay)
+	mult, jitter := r.Multiplier, r.Jitter
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.5
+	}
+	d := float64(initial) * math.Pow(mult, float64(retry-1))
+	if d > float64(maxDelay) {
+		d = float64(maxDelay)
+	}
+	d -= d * jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// retryAfter returns the delay a Retry-After header asks for.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// send sends req with client, retrying according to c.Retry.
+func (c *Config) send(client Client, req *http.Request) (*http.Response, error) {
+	attempts := c.Retry.maxAttempts()
+	if attempts == 1 || !c.Retry.retryable(req.Method) {
+		return client.Do(req)
+	}
+	// A body read from stdin must be kept to send it again.
+	err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		r := req.Clone(ctx)
+		if attempt > 1 && req.GetBody != nil {
+			r.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		resp, err := client.Do(r)
+		if attempt == attempts {
+			return resp, err
+		}
+		var reason string
+		delay := c.Retry.backoff(attempt)
+		switch {
+		case err != nil:
+			if !c.Retry.retryError(err) {
+				return resp, err
+			}
+			reason = err.Error()
+		case c.Retry.retryStatus(resp.StatusCode):
+			reason = "HTTP " + resp.Status
+			if d, ok := retryAfter(resp); ok {
+				limit := time.Duration(c.Retry.MaxRetryAfter)
+				if limit <= 0 {
+					limit = 2 * time.Minute
+				}
+				if d > limit {
+					return resp, nil
+				}
+				delay = d
+			}
+			// Drain some of the body so the connection can be reused.
+			io.CopyN(io.Discard, resp.Body, 64<<10)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		log.Printf("%s %s: %s; retrying in %s", req.Method, req.URL.Redacted(), reason, delay.Round(time.Millisecond))
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("%s; %w", reason, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
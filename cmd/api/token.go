@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gonuts/commander"
+)
+
+var tokenCommand = &commander.Command{
+	Run:       runToken,
+	UsageLine: "token [-authorization]",
+	Short:     "print the current access token",
+	Long: `
+Token prints the access token the configured auth sends,
+refreshing it first if needed.
+With -authorization, it prints the whole Authorization header value.
+`,
+	Flag: *flag.NewFlagSet("token", flag.ExitOnError),
+}
+
+var execCommand = &commander.Command{
+	Run:       runExec,
+	UsageLine: "exec -- command [args...]",
+	Short:     "run a command with the API's credentials in its environment",
+	Long: `
+Exec runs a command with these environment variables set:
+
+	API_BASE_URL       the configured BaseURL
+	API_AUTHORIZATION  the Authorization header value, if any
+	API_TOKEN          the access token, if any
+	API_QUERY          query parameters the auth adds, if any
+	API_HEADER_<NAME>  other headers the auth adds, such as API_HEADER_X_API_KEY
+
+Credentials are refreshed first if needed.
+Auth types that sign each request (aws-sigv4, digest, hmac, httpsig,
+and oauth1) have no reusable credential, so exec refuses to run with them.
+DPoP proofs are good for one request only, so they are left out.
+`,
+}
+
+func init() {
+	tokenCommand.Flag.Bool("authorization", false, "print the whole Authorization header value")
+}
+
+func runToken(cmd *commander.Command, args []string) error {
+	cred, err := config.credentials(cmd)
+	if err != nil {
+		return err
+	}
+	if cmd.Lookup("authorization").(bool) {
+		if cred.Authorization == "" {
+			return fmt.Errorf("auth sets no Authorization header")
+		}
+		fmt.Println(cred.Authorization)
+		return nil
+	}
+	if cred.Token == "" {
+		return fmt.Errorf("auth sets no access token")
+	}
+	fmt.Println(cred.Token)
+	return nil
+}
+
+func runExec(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		cmd.Usage()
+		return fmt.Errorf("missing command")
+	}
+	cred, err := config.credentials(cmd)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), "API_BASE_URL="+config.BaseURL)
+	if cred.Authorization != "" {
+		env = append(env, "API_AUTHORIZATION="+cred.Authorization)
+	}
+	if cred.Token != "" {
+		env = append(env, "API_TOKEN="+cred.Token)
+	}
+	if cred.Query != "" {
+		env = append(env, "API_QUERY="+cred.Query)
+	}
+	for k, v := range cred.Header {
+		name := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		env = append(env, "API_HEADER_"+name+"="+v)
+	}
+	c := exec.CommandContext(cmd.Context(), args[0], args[1:]...)
+	// When api is interrupted or times out, the command is interrupted too,
+	// and has some time to finish before it is killed.
+	c.Cancel = func() error {
+		return c.Process.Signal(os.Interrupt)
+	}
+	c.WaitDelay = 10 * time.Second
+	c.Env = env
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	err = c.Run()
+	if c.ProcessState != nil && c.ProcessState.Success() {
+		// It finished cleanly, even if interrupted.
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
+
+// apiCredentials are what the configured auth adds to a request.
+type apiCredentials struct {
+	Authorization string
+	Token         string            // the Bearer (or DPoP) token in Authorization
+	Query         string            // encoded query parameters
+	Header        map[string]string // headers other than Authorization
+}
+
+// signingAuthTypes compute their Authorization or signature headers
+// for each request, so what they add to one can't be reused.
+var signingAuthTypes = []string{"aws-sigv4", "digest", "hmac", "httpsig", "oauth1"}
+
+// credentials passes a request for the base URL through the auth clients,
+// without sending it, to see what they add.
+func (c *Config) credentials(cmd *commander.Command) (*apiCredentials, error) {
+	types, err := c.authTypes()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if containsString(signingAuthTypes, t) {
+			return nil, fmt.Errorf("%s auth signs each request, so it has no reusable credential", t)
+		}
+	}
+	req, err := c.newRequest(cmd.Context(), "GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	// User-Agent isn't a credential.
+	req.Header.Del("User-Agent")
+	orig := req.URL.Query()
+	capture := &captureClient{}
+	client, err := c.authClient(capture)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if capture.req == nil {
+		return &apiCredentials{}, nil
+	}
+	cred := &apiCredentials{
+		Authorization: capture.req.Header.Get("Authorization"),
+		Header:        make(map[string]string),
+	}
+	scheme, token, _ := strings.Cut(cred.Authorization, " ")
+	if strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "DPoP") {
+		cred.Token = token
+	}
+	for k := range capture.req.Header {
+		// A DPoP proof is good for one request only, so it isn't a credential.
+		if k != "Authorization" && k != "Dpop" {
+			cred.Header[k] = capture.req.Header.Get(k)
+		}
+	}
+	q := capture.req.URL.Query()
+	for k := range orig {
+		q.Del(k)
+	}
+	cred.Query = q.Encode()
+	return cred, nil
+}
+
+// captureClient keeps the last request it is given
+// instead of sending it.
+type captureClient struct {
+	req *http.Request
+}
+
+func (c *captureClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	c.req = req
+	return &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/mstetson/api-client/apiconfig"
+)
+
+// baseTransport and baseClient are used by every auth type
+// in place of http.DefaultTransport and http.DefaultClient.
+// setupTransport configures them from the config.
+var (
+	baseTransport http.RoundTripper = http.DefaultTransport
+	baseClient                      = http.DefaultClient
+)
+
+// HTTPConfig configures the transport shared by all auth types.
+type HTTPConfig struct {
+	// Proxy is an http, https, or socks5 URL, or "direct" for none.
+	// By default, HTTP_PROXY, HTTPS_PROXY, and NO_PROXY are used.
+	Proxy string
+
+	ForceHTTP1 bool // don't negotiate HTTP/2
+	H2C        bool // use HTTP/2 with prior knowledge, without TLS, for an http BaseURL
+
+	// Resolve sends connections for a host and port to other addresses,
+	// each given as host:port:address[,address...] like curl --resolve.
+	Resolve []string
+
+	// Connection pooling. Zero values leave Go's defaults.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     duration
+	DisableKeepAlives   bool
+}
+
+type TLSConfig struct {
+	// Each of these is PEM data, a reference to PEM data, or a file name.
+	// Relative file names are relative to the config file.
+	ClientCert string
+	ClientKey  string // defaults to ClientCert, for files holding both
+	CACert     string // replaces the system roots for the API host
+
+	// Alternatively, a PKCS #12 file (or reference to its base64 form).
+	PKCS12         string
+	PKCS12Password string
+
+	ServerName string   // overrides the name sent to and checked in the API server's certificate
+	MinVersion string   // 1.0, 1.1, 1.2 (default), or 1.3
+	PinSHA256  []string // base64 SHA-256 hashes of acceptable SubjectPublicKeyInfo for the API host
+
+	// Loaded once, for all the transports built from this config.
+	loaded  bool
+	tc      *tls.Config // for all hosts
+	apiTC   *tls.Config // for the API host, if different
+	loadErr error
+}
+
+// TimeoutConfig limits how long requests take.
+// Zero means no limit, except that Connect and TLSHandshake
+// default to 30s and 10s.
+type TimeoutConfig struct {
+	Connect        duration
+	TLSHandshake   duration
+	ResponseHeader duration // after the request is written
+	Total          duration // for each request, including retries and reading the body
+}
+
+// merge returns a copy of c with the nonzero values of o replacing its own.
+func (c *TimeoutConfig) merge(o *TimeoutConfig) *TimeoutConfig {
+	var m TimeoutConfig
+	if c != nil {
+		m = *c
+	}
+	if o == nil {
+		return &m
+	}
+	if o.Connect != 0 {
+		m.Connect = o.Connect
+	}
+	if o.TLSHandshake != 0 {
+		m.TLSHandshake = o.TLSHandshake
+	}
+	if o.ResponseHeader != 0 {
+		m.ResponseHeader = o.ResponseHeader
+	}
+	if o.Total != 0 {
+		m.Total = o.Total
+	}
+	return &m
+}
+
+func (c *Config) setupTransport() error {
+	err := c.splitUnixBaseURL()
+	if err != nil {
+		return err
+	}
+	if c.TLS == nil && c.Timeout == nil && c.HTTP == nil && c.Socket == "" {
+		return nil
+	}
+	t, err := c.newTransport()
+	if err != nil {
+		return err
+	}
+	baseTransport = t
+	baseClient = &http.Client{Transport: t}
+	return nil
+}
+
+// newTransport builds a transport from the HTTP, TLS, Timeout, and Socket settings.
+func (c *Config) newTransport() (http.RoundTripper, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("BaseURL: %w", err)
+	}
+	apiAddr := hostPort(base)
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// The same as http.DefaultTransport's dialer.
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = dialer.DialContext
+	if to := c.Timeout; to != nil {
+		if to.Connect > 0 {
+			dialer.Timeout = time.Duration(to.Connect)
+		}
+		if to.TLSHandshake > 0 {
+			t.TLSHandshakeTimeout = time.Duration(to.TLSHandshake)
+		}
+		t.ResponseHeaderTimeout = time.Duration(to.ResponseHeader)
+	}
+	if c.HTTP != nil {
+		err := c.HTTP.configure(t)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP config: %w", err)
+		}
+	}
+	if c.Socket != "" {
+		// Only connections to the API go to the socket.
+		socket := configRelativePath(c.Socket)
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == apiAddr {
+				return dial(ctx, "unix", socket)
+			}
+			return dial(ctx, network, addr)
+		}
+		if proxy := t.Proxy; proxy != nil {
+			// A proxy can't reach the socket.
+			t.Proxy = func(req *http.Request) (*url.URL, error) {
+				if hostPort(req.URL) == apiAddr {
+					return nil, nil
+				}
+				return proxy(req)
+			}
+		}
+	}
+	var apiTC *tls.Config
+	if c.TLS != nil {
+		if c.TLS.apiOnly() && base.Host == "" {
+			return nil, fmt.Errorf("TLS CACert, ServerName, and PinSHA256 need a BaseURL")
+		}
+		var tc *tls.Config
+		tc, apiTC, err = c.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("TLS config: %w", err)
+		}
+		t.TLSClientConfig = tc
+	}
+	h2c := c.HTTP != nil && c.HTTP.H2C
+	if apiTC == nil && !h2c {
+		return t, nil
+	}
+
+	// Settings for the API host alone go on a transport of its own.
+	apiT := t.Clone()
+	if apiTC != nil {
+		apiT.TLSClientConfig = apiTC
+	}
+	if h2c {
+		if base.Host == "" {
+			return nil, fmt.Errorf("HTTP H2C needs a BaseURL")
+		}
+		err = enableH2C(apiT)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP config: %w", err)
+		}
+	}
+	return apiHostTransport{apiAddr: apiAddr, api: apiT, other: t}, nil
+}
+
+// apiHostTransport sends requests for the API host with one transport,
+// and requests for other hosts, like identity providers, with another.
+type apiHostTransport struct {
+	apiAddr string
+	api     http.RoundTripper
+	other   http.RoundTripper
+}
+
+func (t apiHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hostPort(req.URL) == t.apiAddr {
+		return t.api.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
+
+// hostPort returns u's host and port, adding the scheme's default port.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// splitUnixBaseURL turns a BaseURL of the form unix:///path/to/socket:/api/path
+// into a Socket setting and an http://localhost BaseURL.
+func (c *Config) splitUnixBaseURL() error {
+	rest, ok := strings.CutPrefix(c.BaseURL, "unix://")
+	if !ok {
+		return nil
+	}
+	if c.Socket != "" {
+		return fmt.Errorf("BaseURL is a unix socket, but Socket is also set")
+	}
+	socket, path, _ := strings.Cut(rest, ":")
+	if socket == "" {
+		return fmt.Errorf("BaseURL %s: missing socket path", c.BaseURL)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	c.Socket = socket
+	c.BaseURL = "http://localhost" + path
+	return nil
+}
+
+func (c *HTTPConfig) configure(t *http.Transport) error {
+	switch c.Proxy {
+	case "":
+	case "direct":
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return fmt.Errorf("Proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("Proxy: unsupported scheme %q", u.Scheme)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if c.ForceHTTP1 && c.H2C {
+		return fmt.Errorf("ForceHTTP1 and H2C conflict")
+	}
+	if c.ForceHTTP1 {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil, empty map turns off HTTP/2.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if len(c.Resolve) > 0 {
+		resolve, err := parseResolve(c.Resolve)
+		if err != nil {
+			return err
+		}
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			targets, ok := resolve[addr]
+			if !ok {
+				return dial(ctx, network, addr)
+			}
+			var err error
+			for _, target := range targets {
+				var conn net.Conn
+				conn, err = dial(ctx, network, target)
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	}
+
+	if c.MaxIdleConns != 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = time.Duration(c.IdleConnTimeout)
+	}
+	t.DisableKeepAlives = c.DisableKeepAlives
+	return nil
+}
+
+// parseResolve maps host:port dial addresses to their replacements.
+func parseResolve(entries []string) (map[string][]string, error) {
+	m := make(map[string][]string)
+	for _, e := range entries {
+		host, rest, ok1 := strings.Cut(e, ":")
+		port, addrs, ok2 := strings.Cut(rest, ":")
+		if !ok1 || !ok2 || host == "" || port == "" || addrs == "" {
+			return nil, fmt.Errorf("Resolve %q: want host:port:address", e)
+		}
+		key := net.JoinHostPort(host, port)
+		for _, a := range strings.Split(addrs, ",") {
+			a = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(a), "["), "]")
+			if net.ParseIP(a) == nil {
+				return nil, fmt.Errorf("Resolve %q: bad address %q", e, a)
+			}
+			m[key] = append(m[key], net.JoinHostPort(a, port))
+		}
+	}
+	return m, nil
+}
+
+// load returns the TLS configs for all hosts and for the API host,
+// reading keys and certificates only the first time.
+// The API host's config is nil if it's the same.
+func (c *TLSConfig) load() (tc, apiTC *tls.Config, err error) {
+	if !c.loaded {
+		c.loaded = true
+		c.tc, c.loadErr = c.tlsConfig()
+		if c.loadErr == nil && c.apiOnly() {
+			c.apiTC, c.loadErr = c.apiTLSConfig(c.tc)
+		}
+	}
+	return c.tc, c.apiTC, c.loadErr
+}
+
+// tlsConfig returns the TLS config for all connections.
+func (c *TLSConfig) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	switch c.MinVersion {
+	case "":
+	case "1.0":
+		tc.MinVersion = tls.VersionTLS10
+	case "1.1":
+		tc.MinVersion = tls.VersionTLS11
+	case "1.2":
+		tc.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tc.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unknown MinVersion %s", c.MinVersion)
+	}
+
+	// Client certificates are only sent to servers that ask for them.
+	switch {
+	case c.PKCS12 != "":
+		cert, err := loadPKCS12(c.PKCS12, c.PKCS12Password)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS12: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	case c.ClientCert != "":
+		certPEM, err := loadPEM(c.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("ClientCert: %w", err)
+		}
+		keyPEM := certPEM
+		if c.ClientKey != "" {
+			keyPEM, err = loadPEM(c.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("ClientKey: %w", err)
+			}
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// apiOnly reports whether c has settings that apply only to the API host.
+func (c *TLSConfig) apiOnly() bool {
+	return c.CACert != "" || c.ServerName != "" || len(c.PinSHA256) > 0
+}
+
+// apiTLSConfig returns a copy of tc with the settings
+// for connections to the API host added.
+func (c *TLSConfig) apiTLSConfig(tc *tls.Config) (*tls.Config, error) {
+	tc = tc.Clone()
+	tc.ServerName = c.ServerName
+	if c.CACert != "" {
+		caPEM, err := loadPEM(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("CACert: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("CACert: no certificates found")
+		}
+	}
+
+	if len(c.PinSHA256) > 0 {
+		pins := make(map[string]bool, len(c.PinSHA256))
+		for _, p := range c.PinSHA256 {
+			pins[strings.TrimPrefix(p, "sha256/")] = true
+		}
+		// Pinning is checked in addition to normal verification.
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no pinned public key in certificate chain of %s", cs.ServerName)
+		}
+	}
+	return tc, nil
+}
+
+// loadPEM returns PEM data given directly, by reference, or in a file.
+func loadPEM(s string) ([]byte, error) {
+	s, err := apiconfig.Deref(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(s, "-----BEGIN") {
+		return []byte(s), nil
+	}
+	return os.ReadFile(configRelativePath(s))
+}
+
+// configRelativePath resolves a relative file name
+// against the directory of the config file.
+func configRelativePath(name string) string {
+	if filepath.IsAbs(name) || authState == nil {
+		return name
+	}
+	return filepath.Join(filepath.Dir(authState.FileName), name)
+}
+
+// loadPKCS12 reads a PKCS #12 bundle from a file,
+// or from a reference to its base64 form.
+func loadPKCS12(s, password string) (tls.Certificate, error) {
+	ref, err := apiconfig.Deref(s)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var der []byte
+	if ref != s {
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(ref))
+	} else {
+		der, err = os.ReadFile(configRelativePath(s))
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	password, err = apiconfig.Deref(password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(der, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tc := tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	for _, c := range chain {
+		tc.Certificate = append(tc.Certificate, c.Raw)
+	}
+	return tc, nil
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// enableH2C makes t speak only HTTP/2: without TLS to http URLs,
+// and over TLS to https URLs, so t is used only for the API host.
+func enableH2C(t *http.Transport) error {
+	var p http.Protocols
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	t.Protocols = &p
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Before Go 1.24, h2c needs golang.org/x/net/http2,
+// which this module doesn't depend on.
+func enableH2C(t *http.Transport) error {
+	return fmt.Errorf("H2C needs a build with Go 1.24 or later")
+}
@@ -8,6 +8,7 @@ require (
 	github.com/pelletier/go-toml/v2 v2.1.1
 	github.com/peterhellberg/link v1.2.0
 	golang.org/x/oauth2 v0.17.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
@@ -15,6 +16,7 @@ require (
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/posener/complete v1.2.3 // indirect
+	golang.org/x/crypto v0.20.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect